@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"foxpost-watcher/watcher"
+	"os"
+	"strings"
+)
+
+// diffSnapshots prints the differences of the two snapshots in DIFF_SNAPSHOTS, as text or JSON (set by DIFF_FORMAT)
+func diffSnapshots(e envPrefix) error {
+	paths := splitList(e.StringOrPanic("DIFF_SNAPSHOTS"))
+	if len(paths) != 2 {
+		return fmt.Errorf("DIFF_SNAPSHOTS must hold exactly two paths, got %d", len(paths))
+	}
+	format := e.String("PAYLOAD_FORMAT", "array")
+	wrappedKey := e.String("PAYLOAD_WRAPPED_KEY", "apms")
+
+	oldAPMs, err := watcher.ReadSnapshot(paths[0], format, wrappedKey)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", paths[0], err)
+	}
+	newAPMs, err := watcher.ReadSnapshot(paths[1], format, wrappedKey)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", paths[1], err)
+	}
+	diff := watcher.DiffSnapshots(oldAPMs, newAPMs)
+
+	switch e.String("DIFF_FORMAT", "text") {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diff)
+	case "text":
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%d changed, %d appeared, %d disappeared\n", len(diff.Changed), len(diff.Appeared), len(diff.Disappeared))
+		for _, change := range diff.Changed {
+			fmt.Fprintf(&sb, "~ %d %s: %q -> %q\n", change.PlaceID, change.Name, change.From, change.To)
+		}
+		for _, apmData := range diff.Appeared {
+			fmt.Fprintf(&sb, "+ %d %s (%q)\n", apmData.PlaceID, apmData.Name, apmData.Load)
+		}
+		for _, apmData := range diff.Disappeared {
+			fmt.Fprintf(&sb, "- %d %s (%q)\n", apmData.PlaceID, apmData.Name, apmData.Load)
+		}
+		_, err = os.Stdout.WriteString(sb.String())
+		return err
+	default:
+		return fmt.Errorf("invalid DIFF_FORMAT")
+	}
+}
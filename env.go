@@ -0,0 +1,38 @@
+package main
+
+import (
+	"gitlab.com/MikeTTh/env"
+	"time"
+)
+
+// envPrefix reads env vars prepending a common prefix (set by CONFIG_PREFIX) to their names.
+// This allows running distinct configs side by side, e.g. FOXPOSTA_FOXPOST_PLACE_IDS and FOXPOSTB_FOXPOST_PLACE_IDS
+type envPrefix string
+
+func (p envPrefix) name(name string) string {
+	return string(p) + name
+}
+
+func (p envPrefix) Exists(name string) bool {
+	return env.Exists(p.name(name))
+}
+
+func (p envPrefix) String(name, value string) string {
+	return env.String(p.name(name), value)
+}
+
+func (p envPrefix) StringOrPanic(name string) string {
+	return env.StringOrPanic(p.name(name))
+}
+
+func (p envPrefix) Int(name string, value int) int {
+	return env.Int(p.name(name), value)
+}
+
+func (p envPrefix) Bool(name string, value bool) bool {
+	return env.Bool(p.name(name), value)
+}
+
+func (p envPrefix) Duration(name string, value time.Duration) time.Duration {
+	return env.Duration(p.name(name), value)
+}
@@ -5,269 +5,730 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"foxpost-watcher/watcher"
 	"github.com/hashicorp/go-retryablehttp"
 	influxdb2 "github.com/influxdata/influxdb-client-go"
-	"github.com/influxdata/influxdb-client-go/api/write"
 	"gitlab.com/MikeTTh/env"
 	"log"
+	"log/slog"
+	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
 	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
-type InstanceConfig struct {
-	timeout           time.Duration
-	placeIDs          []uint64
-	influxClient      influxdb2.Client
-	influxOrg         string
-	influxBucket      string
-	influxMeasurement string
-	dryRun            bool
+var backoffMap = map[string]retryablehttp.Backoff{
+	"":                   nil, // use the library default
+	"linear":             retryablehttp.LinearJitterBackoff,
+	"exponential":        retryablehttp.DefaultBackoff,
+	"exponential-jitter": watcher.ExponentialJitterBackoff,
 }
 
-func (ic *InstanceConfig) GetWriter() func(context.Context, *write.Point) error {
+var precisionMap = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"us": time.Microsecond,
+	"ns": time.Nanosecond,
+}
 
-	if ic.dryRun {
-		return func(_ context.Context, point *write.Point) error {
-			tagsStr := ""
-			fieldsStr := ""
-			for _, tag := range point.TagList() {
-				tagsStr += fmt.Sprintf("%s=%s ", tag.Key, tag.Value)
-			}
-			for _, field := range point.FieldList() {
-				fieldsStr += fmt.Sprintf("%s=%+v ", field.Key, field.Value)
-			}
-			log.Printf("[DRY RUN]: Would write datapoint: %s %s %+v", tagsStr, fieldsStr, point.Time())
-			return nil
-		}
-	} else {
-		// Prepare the write api, because we are going to write some serious stuff now.
-		writeAPI := ic.influxClient.WriteAPIBlocking(ic.influxOrg, ic.influxBucket)
-		return func(ctx context.Context, point *write.Point) error {
-			return writeAPI.WritePoint(ctx, point)
-		}
-	}
+var logLevelMap = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
 
+var ipVersionMap = map[string]string{
+	"auto": "tcp",
+	"4":    "tcp4",
+	"6":    "tcp6",
 }
 
-// https://foxpost.hu/uzleti-partnereknek/integracios-segedlet/webapi-integracio#api-4
-type APMData struct {
-	// we only interested in these fields
-	PlaceID    uint64  `json:"place_id"`
-	OperatorID string  `json:"operator_id"`
-	Name       string  `json:"name"`
-	GeoLat     float64 `json:"geolat"`
-	GeoLng     float64 `json:"geolng"`
-	Load       string  `json:"load"`
+// validateBucket checks that the bucket exists, belongs to the configured org and can be written with the token
+func validateBucket(ctx context.Context, client influxdb2.Client, orgName, bucketName string) error {
+	org, err := client.OrganizationsAPI().FindOrganizationByName(ctx, orgName)
+	if err != nil {
+		return fmt.Errorf("could not find org %s: %w", orgName, err)
+	}
+
+	bucket, err := client.BucketsAPI().FindBucketByName(ctx, bucketName)
+	if err != nil {
+		return fmt.Errorf("could not find bucket %s: %w", bucketName, err)
+	}
+
+	if org.Id == nil || bucket.OrgID == nil || *org.Id != *bucket.OrgID {
+		return fmt.Errorf("bucket %s does not belong to org %s", bucketName, orgName)
+	}
+
+	// finding it only needs read permission
+	err = probeWrite(ctx, client, orgName, bucketName)
+	if err != nil {
+		return fmt.Errorf("can not write bucket %s, the token may be read-only: %w", bucketName, err)
+	}
+	return nil
 }
 
-var loadMap = map[string]uint8{
-	// not sure if those two are the same, but they appear similar on the map
-	"":              10,
-	"normal loaded": 10,
-	"medium loaded": 70,
-	"overloaded":    100,
+// pemOrFile returns the value itself if it holds PEM data, otherwise reads the file it points to
+func pemOrFile(value string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return os.ReadFile(value) // #nosec G304 -- path comes from the operator
 }
 
-func loadConfig() *InstanceConfig {
+// maxPlaceIDRange caps the expansion of a single place id range, to catch typos like 100-1000000
+const maxPlaceIDRange = 10000
 
-	placeIDsStr := env.StringOrPanic("FOXPOST_PLACE_IDS")
-	placeIDsStrs := strings.Split(placeIDsStr, ",")
-	if len(placeIDsStrs) == 0 {
-		panic("no place ids?")
-	}
+// parsePlaceIDs parses comma separated place ids and ascending ranges of them (e.g. 100-110,250,300-305)
+func parsePlaceIDs(placeIDsStr string) ([]uint64, error) {
+	placeIDs := make([]uint64, 0)
+	for _, v := range strings.Split(placeIDsStr, ",") {
+		v = strings.TrimSpace(v)
+
+		fromStr, toStr, isRange := strings.Cut(v, "-")
+		from, err := strconv.ParseUint(fromStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid place id: %q", v)
+		}
+		if !isRange {
+			placeIDs = append(placeIDs, from)
+			continue
+		}
 
-	placeIDs := make([]uint64, len(placeIDsStrs))
-	for i, v := range placeIDsStrs {
-		placeID, err := strconv.ParseUint(v, 10, 64)
+		to, err := strconv.ParseUint(toStr, 10, 64)
 		if err != nil {
-			panic("invalid place id")
+			return nil, fmt.Errorf("invalid place id range: %q", v)
+		}
+		if to < from {
+			return nil, fmt.Errorf("place id range is not ascending: %q", v)
+		}
+		if to-from >= maxPlaceIDRange {
+			return nil, fmt.Errorf("place id range is too large (max %d ids): %q", maxPlaceIDRange, v)
+		}
+		// count instead of comparing the ids, placeID++ would wrap around at the end of a range up to MaxUint64
+		for n := uint64(0); n <= to-from; n++ {
+			placeIDs = append(placeIDs, from+n)
 		}
-		placeIDs[i] = placeID
 	}
 
-	dryRun := env.Bool("DRY_RUN", false)
+	if len(placeIDs) == 0 {
+		return nil, errors.New("no place ids?")
+	}
+	return placeIDs, nil
+}
 
-	influxOrg := ""
-	influxBucket := ""
-	var influxClient influxdb2.Client
+// splitList splits a comma separated list, dropping the empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
 
-	if !dryRun {
-		log.Println("Setting up influxdb client...")
-		influxOrg = env.StringOrPanic("INFLUX_SERVER_ORG")
-		influxBucket = env.StringOrPanic("INFLUX_SERVER_BUCKET")
-
-		const extraCAEnvvarName = "INFLUX_SERVER_EXTRA_CA"
-		clientOpts := influxdb2.DefaultOptions()
-		if env.Exists(extraCAEnvvarName) {
-			log.Println("Loading extra CA cert from envvar...")
-			// get the current cert pool, or a new one
-			rootCAs, _ := x509.SystemCertPool()
-			if rootCAs == nil {
-				rootCAs = x509.NewCertPool()
-			}
+// newInfluxClient creates the InfluxDB client, loading the extra CA cert, and checks its health
+func newInfluxClient(e envPrefix, precision time.Duration) (influxdb2.Client, error) {
+	const extraCAEnvvarName = "INFLUX_SERVER_EXTRA_CA"
+	clientOpts := influxdb2.DefaultOptions().
+		SetPrecision(precision).
+		SetUseGZip(e.Bool("INFLUX_WRITE_GZIP", false)). // applies to both the blocking and the async write api
+		// the writes are retried by the watcher (WRITE_RETRIES). The client would queue the batches failing with 429 or
+		// 503 instead, to send them with the next write, and the next writes within the retry interval would only
+		// queue their batch and return nil, so they would be counted as written without ever reaching InfluxDB
+		SetMaxRetries(0)
+	if e.Exists(extraCAEnvvarName) {
+		log.Println("Loading extra CA cert...")
+		caPEM, err := pemOrFile(e.StringOrPanic(extraCAEnvvarName))
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", extraCAEnvvarName, err)
+		}
 
-			// append our cert
-			rootCAs.AppendCertsFromPEM([]byte(env.StringOrPanic(extraCAEnvvarName)))
+		// get the current cert pool, or a new one
+		rootCAs, _ := x509.SystemCertPool()
+		if rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
 
-			// set it in the client options
-			clientOpts = clientOpts.SetTLSConfig(&tls.Config{
-				RootCAs:    rootCAs,
-				MinVersion: tls.VersionTLS12, // just to make gosec happy
-			})
+		// append our cert
+		if !rootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("invalid %s: no certs found", extraCAEnvvarName)
 		}
 
-		influxClient = influxdb2.NewClientWithOptions(
-			env.StringOrPanic("INFLUX_SERVER_URL"),
-			env.StringOrPanic("INFLUX_SERVER_TOKEN"),
-			clientOpts,
-		)
+		// set it in the client options
+		clientOpts = clientOpts.SetTLSConfig(&tls.Config{
+			RootCAs:    rootCAs,
+			MinVersion: tls.VersionTLS12, // just to make gosec happy
+		})
+	}
+
+	influxClient := influxdb2.NewClientWithOptions(
+		e.StringOrPanic("INFLUX_SERVER_URL"),
+		e.StringOrPanic("INFLUX_SERVER_TOKEN"),
+		clientOpts,
+	)
 
+	check := e.String("INFLUX_HEALTH_CHECK", "health")
+	if !slices.Contains([]string{"health", "write", "none"}, check) {
+		return nil, errors.New("invalid INFLUX_HEALTH_CHECK")
+	}
+	retries := max(e.Int("INFLUX_HEALTHCHECK_RETRIES", 0), 0)
+	interval := durationInRange(e, "INFLUX_HEALTHCHECK_INTERVAL", 5*time.Second, 0, 24*time.Hour)
+	for attempt := 1; ; attempt++ {
+		err := checkInflux(e, influxClient, check)
+		if err == nil {
+			return influxClient, nil
+		}
+		if attempt > retries {
+			influxClient.Close()
+			return nil, err
+		}
+		// InfluxDB may just not be ready yet, when started together
+		log.Printf("%s, retrying in %s (%d/%d)...", err, interval, attempt, retries)
+		time.Sleep(interval)
+	}
+}
+
+// checkInflux checks the client as set by INFLUX_HEALTH_CHECK
+func checkInflux(e envPrefix, influxClient influxdb2.Client, check string) error {
+	switch check {
+	case "health":
 		hc, err := influxClient.Health(context.Background())
 		if err != nil {
-			panic("influxdb health check failed")
+			return errors.New("influxdb health check failed")
 		}
-		log.Println("InfluxDB initial health check result: ", hc.Status)
-	} else {
-		log.Println("Dry run enabled! Not setting up Influx Client")
+		log.Println("InfluxDB health check result: ", hc.Status)
+	case "write":
+		// bucket scoped tokens may not pass the health check, but all we need is to be able to write
+		err := probeWrite(context.Background(), influxClient, e.StringOrPanic("INFLUX_SERVER_ORG"), e.StringOrPanic("INFLUX_SERVER_BUCKET"))
+		if err != nil {
+			return fmt.Errorf("influxdb write probe failed: %w", err)
+		}
+		log.Println("InfluxDB write probe succeeded")
+	case "none":
+		log.Println("InfluxDB health check skipped")
 	}
+	return nil
+}
+
+// probeWrite checks that the token can write the bucket, with a write request without points: InfluxDB checks the
+// token against the bucket before parsing the body, so nothing is stored
+func probeWrite(ctx context.Context, client influxdb2.Client, org, bucket string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return client.WriteAPIBlocking(org, bucket).WritePoint(ctx)
+}
 
-	return &InstanceConfig{
-		timeout:           env.Duration("INVOCATION_TIMEOUT", time.Minute),
-		placeIDs:          placeIDs,
-		influxClient:      influxClient,
-		influxOrg:         influxOrg,
-		influxBucket:      influxBucket,
-		influxMeasurement: env.String("INFLUX_MEASUREMENT", "foxpost"),
-		dryRun:            dryRun,
+// reloadOnSighup recreates the InfluxDB client on every SIGHUP, e.g. to pick up a rotated CA cert.
+// The old client is kept if the new one fails.
+func reloadOnSighup(w *watcher.Watcher, reload func() (influxdb2.Client, error)) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		log.Println("SIGHUP received, reloading the InfluxDB client...")
+		client, err := reload()
+		if err != nil {
+			log.Println("Reloading the InfluxDB client failed, keeping the old one: ", err)
+			continue
+		}
+		w.SetInfluxClient(client).Close()
+		log.Println("InfluxDB client reloaded")
+	}
+}
+
+// maxInvocationTimeoutRatio is the largest part of POLL_INTERVAL a run may take with INVOCATION_TIMEOUT_RATIO
+const maxInvocationTimeoutRatio = 0.9
+
+// durationInRange reads a duration envvar, panics if it is outside [min, max]
+func durationInRange(e envPrefix, name string, value, min, max time.Duration) time.Duration {
+	d := e.Duration(name, value)
+	if d < min || d > max {
+		panic(fmt.Sprintf("invalid %s: %s is not between %s and %s", name, d, min, max))
 	}
+	return d
 }
 
-func run(ctx context.Context, ic *InstanceConfig) error {
+// cliConfig holds the options only the command line program cares about
+type cliConfig struct {
+	oneShot           bool
+	cdnWarmup         bool
+	strictWarmup      bool
+	startupDelay      time.Duration
+	replayDeadLetters bool
+	printSchema       bool
+	serveRequired     bool                             // MODE=serve, fail if the HTTP server can't start
+	reloadInflux      func() (influxdb2.Client, error) // nil in dry run
+}
+
+// loadConfig reads the config from the env, panics on anything invalid
+func loadConfig() (*watcher.Watcher, cliConfig) {
+	e := envPrefix(env.String("CONFIG_PREFIX", ""))
+
+	cities := splitList(e.String("FOXPOST_CITIES", ""))
+	zips := splitList(e.String("FOXPOST_ZIPS", ""))
+
+	var placeIDs []uint64
 	var err error
+	if e.Exists("FOXPOST_PLACE_IDS") || (len(cities) == 0 && len(zips) == 0) {
+		placeIDs, err = parsePlaceIDs(e.StringOrPanic("FOXPOST_PLACE_IDS"))
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	cl := retryablehttp.NewClient()
+	httpBackoff, ok := backoffMap[e.String("HTTP_BACKOFF", "")]
+	if !ok {
+		panic("invalid HTTP_BACKOFF")
+	}
 
-	var req *retryablehttp.Request
-	req, err = retryablehttp.NewRequestWithContext(ctx, http.MethodGet, "https://cdn.foxpost.hu/apms.json", nil)
-	if err != nil {
-		return err
+	var logResponseHeaders []string
+	for _, name := range strings.Split(e.String("LOG_RESPONSE_HEADERS", ""), ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			logResponseHeaders = append(logResponseHeaders, http.CanonicalHeaderKey(name))
+		}
 	}
 
-	var resp *http.Response
-	resp, err = cl.Do(req)
-	if err != nil {
-		return err
+	httpLogLevel, ok := logLevelMap[e.String("HTTP_LOG_LEVEL", "info")]
+	if !ok {
+		panic("invalid HTTP_LOG_LEVEL")
 	}
-	defer resp.Body.Close()
+	httpLogger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: httpLogLevel}))
 
-	ts := time.Now() // record the time of the successful request
+	httpNetwork, ok := ipVersionMap[e.String("HTTP_IP_VERSION", "auto")]
+	if !ok {
+		panic("invalid HTTP_IP_VERSION")
+	}
 
-	// this is "slipped" through the retrier
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected HTTP status: %d", resp.StatusCode)
+	var sortByPlaceID bool
+	switch e.String("SORT_OUTPUT", "") {
+	case "":
+	case "place_id":
+		sortByPlaceID = true
+	default:
+		panic("invalid SORT_OUTPUT")
 	}
 
-	// cool and good, parse response
-	var apmsData []APMData
-	err = json.NewDecoder(resp.Body).Decode(&apmsData)
-	if err != nil {
-		return err
+	var congestionWeights map[string]float64
+	if e.Bool("EMIT_CONGESTION_INDEX", false) {
+		congestionWeights = watcher.DefaultCongestionWeights()
+		if e.Exists("CONGESTION_WEIGHTS") {
+			congestionWeights = nil // only the configured ones
+			err = json.Unmarshal([]byte(e.String("CONGESTION_WEIGHTS", "")), &congestionWeights)
+			if err != nil {
+				panic("invalid CONGESTION_WEIGHTS")
+			}
+		}
 	}
 
-	writer := ic.GetWriter()
+	influxPrecision, ok := precisionMap[e.String("INFLUX_PRECISION", "ns")]
+	if !ok {
+		panic("invalid INFLUX_PRECISION")
+	}
 
-	for _, apmData := range apmsData {
-		if slices.Contains(ic.placeIDs, apmData.PlaceID) {
-			// this is a place of interest. Record its status
-			log.Printf("Found place %d", apmData.PlaceID)
+	var fieldNameMap map[string]string
+	if e.Exists("FIELD_NAME_MAP") {
+		err = json.Unmarshal([]byte(e.String("FIELD_NAME_MAP", "")), &fieldNameMap)
+		if err != nil {
+			panic("invalid FIELD_NAME_MAP")
+		}
+	}
 
-			loadVal, ok := loadMap[apmData.Load]
-			if !ok {
-				return fmt.Errorf("invalid load value: %s", apmData.Load)
-			}
+	writeFields := splitList(e.String("WRITE_FIELDS", ""))
 
-			tags := map[string]string{
-				"place_id":    strconv.FormatUint(apmData.PlaceID, 10),
-				"operator_id": apmData.OperatorID,
-				"name":        apmData.Name,
-			}
+	emptyLoadValue := e.Int("EMPTY_LOAD_VALUE", 10)
+	if emptyLoadValue < 0 || emptyLoadValue > 255 {
+		panic("invalid EMPTY_LOAD_VALUE")
+	}
 
-			fields := map[string]interface{}{
-				"load":   loadVal,
-				"geoLat": apmData.GeoLat,
-				"geoLng": apmData.GeoLng,
-			}
+	var loadBands []uint8
+	for _, v := range splitList(e.String("LOAD_BANDS", "")) {
+		threshold, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			panic("invalid LOAD_BANDS")
+		}
+		loadBands = append(loadBands, uint8(threshold))
+	}
+
+	var transitionBands []int
+	for _, v := range splitList(e.String("TRANSITION_BANDS", "")) {
+		band, err := strconv.Atoi(v)
+		if err != nil {
+			panic("invalid TRANSITION_BANDS")
+		}
+		transitionBands = append(transitionBands, band)
+	}
+
+	enrichFields := splitList(e.String("ENRICH_FIELDS", ""))
+
+	var bandBuckets map[int]string
+	if e.Exists("BAND_BUCKET_MAP") {
+		// json can't have numeric keys, but decodes them into ints
+		err = json.Unmarshal([]byte(e.String("BAND_BUCKET_MAP", "")), &bandBuckets)
+		if err != nil {
+			panic("invalid BAND_BUCKET_MAP")
+		}
+	}
+
+	var httpTLSCert *tls.Certificate
+	if e.Exists("METRICS_TLS_CERT") || e.Exists("METRICS_TLS_KEY") {
+		certPEM, err := pemOrFile(e.StringOrPanic("METRICS_TLS_CERT"))
+		if err != nil {
+			panic("could not read METRICS_TLS_CERT: " + err.Error())
+		}
+		keyPEM, err := pemOrFile(e.StringOrPanic("METRICS_TLS_KEY"))
+		if err != nil {
+			panic("could not read METRICS_TLS_KEY: " + err.Error())
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			panic("invalid METRICS_TLS_CERT or METRICS_TLS_KEY: " + err.Error())
+		}
+		httpTLSCert = &cert
+	}
+
+	httpAuthUser := e.String("METRICS_AUTH_USER", "")
+	httpAuthPass := ""
+	if httpAuthUser != "" {
+		httpAuthPass = e.StringOrPanic("METRICS_AUTH_PASS")
+	}
+
+	var apmJSONFieldMap map[string]string
+	if e.Exists("APM_JSON_FIELD_MAP") {
+		err = json.Unmarshal([]byte(e.String("APM_JSON_FIELD_MAP", "")), &apmJSONFieldMap)
+		if err != nil {
+			panic("invalid APM_JSON_FIELD_MAP")
+		}
+	}
+
+	printSchema := e.Bool("PRINT_SCHEMA", false)
+	dryRunDiff := e.Bool("DRY_RUN_DIFF", false) && !printSchema
+	dryRun := (e.Bool("DRY_RUN", false) && !dryRunDiff) || printSchema // the diff needs InfluxDB, the schema nothing
+	// MODE takes precedence over ONESHOT, which is kept for compatibility
+	var oneShot, replayDeadLetters, serveRequired bool
+	switch e.String("MODE", "") {
+	case "":
+		oneShot = e.Bool("ONESHOT", false)
+	case "oneshot":
+		oneShot = true
+	case "daemon":
+	case "replay-deadletter":
+		oneShot = true
+		replayDeadLetters = true
+		if e.String("DEADLETTER_FILE", "") == "" {
+			panic("MODE=replay-deadletter requires DEADLETTER_FILE")
+		}
+		if e.Bool("DRY_RUN", false) || e.String("OUTPUT", "influxdb") != "influxdb" {
+			panic("MODE=replay-deadletter writes to InfluxDB, so it can not be used with DRY_RUN or OUTPUT=udp")
+		}
+	case "serve":
+		// daemon with the read API always on
+		if e.String("METRICS_LISTEN", "") == "" {
+			panic("MODE=serve requires METRICS_LISTEN")
+		}
+		serveRequired = true
+	default:
+		panic("invalid MODE")
+	}
 
-			p := influxdb2.NewPoint(ic.influxMeasurement, tags, fields, ts)
+	influxOrg := ""
+	influxBucket := ""
+	var influxClient influxdb2.Client
+	var reloadInflux func() (influxdb2.Client, error)
 
-			err = writer(ctx, p)
+	output := e.String("OUTPUT", "influxdb")
+	if !dryRun && (output == "influxdb" || dryRunDiff) {
+		log.Println("Setting up influxdb client...")
+		influxOrg = e.StringOrPanic("INFLUX_SERVER_ORG")
+		influxBucket = e.StringOrPanic("INFLUX_SERVER_BUCKET")
+
+		influxClient, err = newInfluxClient(e, influxPrecision)
+		if err != nil {
+			panic(err)
+		}
+		reloadInflux = func() (influxdb2.Client, error) {
+			return newInfluxClient(e, influxPrecision)
+		}
+
+		for band, bucket := range bandBuckets {
+			// a typo would only turn up once a place gets into the band
+			err = validateBucket(context.Background(), influxClient, influxOrg, bucket)
 			if err != nil {
-				return err
+				panic(fmt.Sprintf("invalid bucket of band %d in BAND_BUCKET_MAP: %s", band, err))
 			}
-
 		}
-		// check if context is closed every iteration
-		if ctx.Err() != nil {
-			return ctx.Err()
+
+		if e.Bool("INFLUX_VALIDATE_BUCKET", false) {
+			err = validateBucket(context.Background(), influxClient, influxOrg, influxBucket)
+			if err != nil {
+				if oneShot {
+					panic(err)
+				}
+				log.Println("WARNING: InfluxDB bucket validation failed: ", err)
+			} else {
+				log.Println("InfluxDB bucket validated")
+			}
 		}
+	} else if dryRun {
+		log.Println("Dry run enabled! Not setting up Influx Client")
+	} else {
+		log.Println("Writing to", output, "instead of InfluxDB, not setting up Influx Client")
 	}
 
-	log.Println("Success!")
-	return nil
-}
+	var overloadRatioThreshold float64
+	if e.Exists("OVERLOAD_RATIO_THRESHOLD") {
+		overloadRatioThreshold, err = strconv.ParseFloat(e.String("OVERLOAD_RATIO_THRESHOLD", ""), 64)
+		if err != nil {
+			panic("invalid OVERLOAD_RATIO_THRESHOLD")
+		}
+	}
 
-func invoke(ic *InstanceConfig) error {
-	ctx, cancel := context.WithTimeout(context.Background(), ic.timeout)
-	defer cancel()
-	return run(ctx, ic)
-}
+	var loadSmoothingAlpha float64
+	if e.Bool("EMIT_SMOOTHED_LOAD", false) {
+		loadSmoothingAlpha, err = strconv.ParseFloat(e.String("LOAD_SMOOTHING_ALPHA", "0.3"), 64)
+		if err != nil || loadSmoothingAlpha <= 0 || loadSmoothingAlpha > 1 {
+			panic("LOAD_SMOOTHING_ALPHA must be a number in (0, 1]")
+		}
+	}
 
-func safeInvoke(ic *InstanceConfig) {
-	// Used by the daemon, so if won't crash
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("PANIC! ", r, " (recovered)")
+	pollInterval := durationInRange(e, "POLL_INTERVAL", time.Hour, time.Second, 31*24*time.Hour)
+	timeout := durationInRange(e, "INVOCATION_TIMEOUT", time.Minute, time.Second, 24*time.Hour)
+	if e.Exists("INVOCATION_TIMEOUT_RATIO") && !oneShot {
+		ratio, err := strconv.ParseFloat(e.String("INVOCATION_TIMEOUT_RATIO", ""), 64)
+		if err != nil || ratio <= 0 || ratio > maxInvocationTimeoutRatio {
+			panic(fmt.Sprintf("invalid INVOCATION_TIMEOUT_RATIO: must be above 0 and at most %g, to leave time before the next tick", maxInvocationTimeoutRatio))
+		}
+		scaled := time.Duration(ratio * float64(pollInterval))
+		if e.Exists("INVOCATION_TIMEOUT") {
+			scaled = min(scaled, timeout) // an explicit timeout caps it
 		}
-	}()
+		timeout = max(scaled, time.Second)
+	}
+
+	startupDelay := durationInRange(e, "STARTUP_DELAY", 0, 0, 24*time.Hour)
+	if startupDelay > 0 && e.Bool("STARTUP_DELAY_RANDOM", false) {
+		startupDelay = time.Duration(rand.Int63n(int64(startupDelay))) // #nosec G404 -- staggering does not need crypto rand
+	}
 
-	err := invoke(ic)
+	w, err := watcher.New(watcher.Config{
+		Timeout:                timeout,
+		FetchBudget:            e.Duration("CDN_FETCH_BUDGET", 0),
+		PlaceIDs:               placeIDs,
+		Cities:                 cities,
+		Zips:                   zips,
+		APMsURLs:               splitList(e.String("FOXPOST_APMS_URLS", "https://cdn.foxpost.hu/apms.json")),
+		SourceAs:               e.String("SOURCE_AS", ""),
+		MaxResponseBytes:       int64(e.Int("MAX_RESPONSE_BYTES", 64<<20)),
+		HTTPMethod:             strings.ToUpper(e.String("FOXPOST_HTTP_METHOD", "GET")),
+		RequestBody:            e.String("FOXPOST_REQUEST_BODY", ""),
+		PayloadFormat:          e.String("PAYLOAD_FORMAT", "array"),
+		PayloadWrappedKey:      e.String("PAYLOAD_WRAPPED_KEY", "apms"),
+		APMJSONFieldMap:        apmJSONFieldMap,
+		ValidateSchema:         e.Bool("VALIDATE_SCHEMA", false),
+		ExtraFields:            splitList(e.String("EXTRA_FIELDS", "")),
+		EmitRunEvents:          e.Bool("EMIT_RUN_EVENTS", false),
+		EmitHeartbeat:          e.Bool("EMIT_HEARTBEAT", false),
+		VersionTag:             e.Bool("EMIT_VERSION_TAG", false),
+		InstanceTag:            e.Bool("EMIT_INSTANCE_TAG", false),
+		InstanceID:             e.String("INSTANCE_ID", ""),
+		VersionField:           e.Bool("EMIT_VERSION_FIELD", false),
+		EmitPollSeq:            e.Bool("EMIT_POLL_SEQ", false),
+		LogResponseHeaders:     logResponseHeaders,
+		Output:                 output,
+		UDPAddr:                e.String("OUTPUT_UDP_ADDR", ""),
+		InfluxClient:           influxClient,
+		InfluxOrg:              influxOrg,
+		InfluxBucket:           influxBucket,
+		BandBuckets:            bandBuckets,
+		InfluxMeasurement:      e.String("INFLUX_MEASUREMENT", "foxpost"),
+		InfluxPrecision:        influxPrecision,
+		TimestampSource:        e.String("TIMESTAMP_SOURCE", "fetch"),
+		MaxClockSkew:           durationInRange(e, "MAX_CLOCK_SKEW", 24*time.Hour, time.Second, 10*365*24*time.Hour),
+		DryRun:                 dryRun,
+		DryRunDiff:             dryRunDiff,
+		DryRunDiffRange:        durationInRange(e, "DRY_RUN_DIFF_RANGE", 30*24*time.Hour, time.Hour, 10*365*24*time.Hour),
+		HTTPBackoff:            httpBackoff,
+		HTTPNetwork:            httpNetwork,
+		HTTPDisableKeepAlive:   e.Bool("HTTP_DISABLE_KEEPALIVE", false),
+		HTTPIdleConnTimeout:    durationInRange(e, "HTTP_IDLE_CONN_TIMEOUT", 0, 0, 24*time.Hour),
+		HTTPLogger:             httpLogger,
+		PollInterval:           pollInterval,
+		MaxLifetime:            durationInRange(e, "DAEMON_MAX_LIFETIME", 0, 0, 10*365*24*time.Hour),
+		HTTPListen:             e.String("METRICS_LISTEN", ""),
+		HTTPTLSCert:            httpTLSCert,
+		HTTPAuthUser:           httpAuthUser,
+		HTTPAuthPass:           httpAuthPass,
+		HTTPTrigger:            e.Bool("METRICS_TRIGGER", false),
+		HTTPTriggerMinInterval: durationInRange(e, "METRICS_TRIGGER_MIN_INTERVAL", time.Minute, 0, 24*time.Hour),
+		SummaryEvery:           e.Int("SUMMARY_EVERY_RUNS", 24),
+		RunHistorySize:         e.Int("RUN_HISTORY_SIZE", 20),
+		RuntimeStatsInterval:   durationInRange(e, "RUNTIME_STATS_INTERVAL", 0, 0, 24*time.Hour),
+		EmitLoadDelta:          e.Bool("EMIT_LOAD_DELTA", false),
+		FieldLayout:            e.String("FIELD_LAYOUT", "wide"),
+		LoadSmoothingAlpha:     loadSmoothingAlpha,
+		EmitDataLag:            e.Bool("EMIT_DATA_LAG", false),
+		EmitNearestNeighbor:    e.Bool("EMIT_NEAREST_NEIGHBOR", false),
+		SortByPlaceID:          sortByPlaceID,
+		DuplicatePlacePolicy:   e.String("DUPLICATE_PLACE_POLICY", ""),
+		EmitMissing:            e.Bool("EMIT_MISSING", false),
+		MissingGracePolls:      e.Int("MISSING_GRACE_POLLS", 0),
+		WriteBatchSize:         e.Int("WRITE_BATCH_SIZE", 1),
+		DeadLetterFile:         e.String("DEADLETTER_FILE", ""),
+		MaxWriteErrors:         max(e.Int("MAX_WRITE_ERRORS", 0), 0),
+		WriteRetries:           e.Int("WRITE_RETRIES", 2),
+		WriteRetryBackoff:      durationInRange(e, "WRITE_RETRY_BACKOFF", time.Second, 0, 24*time.Hour),
+		CrashOnPanic:           e.Bool("DAEMON_CRASH_ON_PANIC", false),
+		CongestionWeights:      congestionWeights,
+		QuietStart:             e.Bool("QUIET_START", false),
+		EmitLoadMapMeta:        e.Bool("EMIT_LOAD_MAP_META", false),
+		FieldNameMap:           fieldNameMap,
+		WriteFields:            writeFields,
+		PostRunCommand:         e.String("POST_RUN_COMMAND", ""),
+		PostRunTimeout:         durationInRange(e, "POST_RUN_TIMEOUT", 30*time.Second, time.Second, 24*time.Hour),
+		PostRunFailRun:         e.Bool("POST_RUN_FAIL_RUN", false),
+		EnrichDetails:          e.Bool("ENRICH_DETAILS", false),
+		DetailURLTemplate:      e.String("FOXPOST_DETAIL_URL_TEMPLATE", ""),
+		EnrichFields:           enrichFields,
+		EnrichConcurrency:      e.Int("ENRICH_CONCURRENCY", 4),
+		EmptyLoadMode:          e.String("EMPTY_LOAD_MODE", ""),
+		EmptyLoadValue:         uint8(emptyLoadValue),
+		LoadEncoding:           e.String("LOAD_ENCODING", "percent"),
+		NormalizeTags:          e.Bool("NORMALIZE_TAGS", false),
+		LowercaseTags:          e.Bool("NORMALIZE_TAGS_LOWERCASE", false),
+		KeepOriginalTags:       e.Bool("NORMALIZE_TAGS_KEEP_ORIGINAL", false),
+		BandOnly:               e.Bool("BAND_ONLY", false),
+		TransitionOnly:         e.Bool("TRANSITION_ONLY", false),
+		TransitionBands:        transitionBands,
+		EmitBandFlags:          e.Bool("EMIT_BAND_FLAGS", false),
+		LoadBands:              loadBands,
+		ContinueOnPlacePanic:   e.Bool("CONTINUE_ON_PLACE_PANIC", false),
+		TrackMetadataChanges:   e.Bool("TRACK_METADATA_CHANGES", false),
+		OverloadRatioThreshold: overloadRatioThreshold,
+		OverloadAlertCooldown:  durationInRange(e, "OVERLOAD_ALERT_COOLDOWN", 0, 0, 31*24*time.Hour),
+		AlertStateFile:         e.String("ALERT_STATE_FILE", ""),
+		TelegramBotToken:       e.String("TELEGRAM_BOT_TOKEN", ""),
+		TelegramChatID:         e.String("TELEGRAM_CHAT_ID", ""),
+		TelegramAPIURL:         e.String("TELEGRAM_API_URL", "https://api.telegram.org"),
+		TopNLoaded:             e.Int("TOP_N_LOADED", 0),
+		FailOnZeroPoints:       e.Bool("FAIL_ON_ZERO_POINTS", false),
+	})
 	if err != nil {
-		log.Println("Error while running collection: ", err)
-		return
+		panic(err)
+	}
+
+	return w, cliConfig{
+		oneShot:           oneShot,
+		cdnWarmup:         e.Bool("CDN_WARMUP", false),
+		strictWarmup:      e.Bool("STRICT_WARMUP", false),
+		startupDelay:      startupDelay,
+		replayDeadLetters: replayDeadLetters,
+		printSchema:       printSchema,
+		serveRequired:     serveRequired,
+		reloadInflux:      reloadInflux,
 	}
 }
 
-func daemon(ic *InstanceConfig) {
-	log.Println("Starting ticker...")
-	ticker := time.NewTicker(env.Duration("POLL_INTERVAL", time.Hour))
+// sleepUnlessSignaled waits for d, returns false if SIGINT or SIGTERM arrived in the meantime
+func sleepUnlessSignaled(d time.Duration) bool {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	for range ticker.C {
-		log.Println("Tick!")
-		safeInvoke(ic)
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
 func main() {
+	e := envPrefix(env.String("CONFIG_PREFIX", ""))
+	if e.String("MODE", "") == "diff-snapshots" {
+		// offline, no config needed beyond the snapshots
+		err := diffSnapshots(e)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if e.Bool("VALIDATE", false) {
+		// check everything without writing anything
+		if !validate() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.Println("Parsing config...")
-	ic := loadConfig()
+	w, cli := loadConfig()
+
+	if cli.printSchema {
+		fmt.Print(w.Schema())
+		return
+	}
+
+	if cli.replayDeadLetters {
+		log.Println("Replaying the dead letters of", w.DeadLetterFile)
+		n, err := w.ReplayDeadLetters(context.Background())
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("Replayed %d dead letters", n)
+		return
+	}
 
-	oneShot := env.Bool("ONESHOT", false)
-	if oneShot {
+	if cli.cdnWarmup {
+		log.Println("Warming up...")
+		err := w.WarmUp()
+		if err != nil {
+			if cli.oneShot && cli.strictWarmup {
+				panic(err)
+			}
+			log.Println("Warm-up failed: ", err)
+		}
+	}
+
+	if cli.oneShot {
 		// run once, crash on failure
 		log.Println("Running in one-shot mode...")
-		err := invoke(ic)
+		err := w.RunOnce()
 		if err != nil {
 			panic(err)
 		}
 	} else {
 		// run as daemon, protected from crashing
 		log.Println("Running as daemon...")
-		safeInvoke(ic)
-		daemon(ic)
+		if cli.serveRequired {
+			// bound right away, so the daemon does not run without the server it is meant to provide
+			ln, err := w.Listen()
+			if err != nil {
+				panic(fmt.Sprintf("MODE=serve could not start the HTTP server: %s", err))
+			}
+			go w.ServeListener(ln)
+		} else if w.HTTPListen != "" {
+			go w.Serve()
+		}
+		if cli.reloadInflux != nil {
+			go reloadOnSighup(w, cli.reloadInflux)
+		}
+		if cli.startupDelay > 0 {
+			log.Println("Waiting", cli.startupDelay.Round(time.Second), "before the first run...")
+			if !sleepUnlessSignaled(cli.startupDelay) {
+				log.Println("Shutting down")
+				return
+			}
+		}
+		w.Run()
 	}
 
 }
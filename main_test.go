@@ -0,0 +1,370 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"foxpost-watcher/watcher"
+	"github.com/hashicorp/go-retryablehttp"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParsePlaceIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []uint64
+		wantErr bool
+	}{
+		{name: "single", in: "1001", want: []uint64{1001}},
+		{name: "list", in: "1001, 1003,1002", want: []uint64{1001, 1003, 1002}},
+		{name: "range", in: "1001-1003", want: []uint64{1001, 1002, 1003}},
+		{name: "single id range", in: "7-7", want: []uint64{7}},
+		{name: "mixed", in: "5,1001-1002,9", want: []uint64{5, 1001, 1002, 9}},
+		{name: "range up to the max", in: "18446744073709551614-18446744073709551615", want: []uint64{math.MaxUint64 - 1, math.MaxUint64}},
+		{name: "largest range", in: "1-10000", want: nil}, // only the length is checked
+		{name: "empty", in: "", wantErr: true},
+		{name: "empty item", in: "1001,,1002", wantErr: true},
+		{name: "not a number", in: "abc", wantErr: true},
+		{name: "negative", in: "-5", wantErr: true},
+		{name: "descending range", in: "1003-1001", wantErr: true},
+		{name: "open range", in: "1001-", wantErr: true},
+		{name: "too large range", in: "1-10001", wantErr: true},
+		{name: "overflow", in: "18446744073709551616", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePlaceIDs(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parsePlaceIDs(%q) = %v, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePlaceIDs(%q) failed: %s", tt.in, err)
+			}
+			if tt.want == nil {
+				if len(got) != maxPlaceIDRange {
+					t.Errorf("parsePlaceIDs(%q) returned %d ids, want %d", tt.in, len(got), maxPlaceIDRange)
+				}
+				return
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parsePlaceIDs(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDurationInRange(t *testing.T) {
+	const prefix = envPrefix("FW_TEST_")
+	tests := []struct {
+		name      string
+		value     string // unset if empty
+		want      time.Duration
+		wantPanic bool
+	}{
+		{name: "default", want: 5 * time.Second},
+		{name: "in range", value: "1m", want: time.Minute},
+		{name: "lower bound", value: "1s", want: time.Second},
+		{name: "upper bound", value: "1h", want: time.Hour},
+		{name: "too short", value: "999ms", wantPanic: true},
+		{name: "too long", value: "61m", wantPanic: true},
+		{name: "negative", value: "-1m", wantPanic: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.value != "" {
+				t.Setenv("FW_TEST_INTERVAL", tt.value)
+			}
+			defer func() {
+				r := recover()
+				if (r != nil) != tt.wantPanic {
+					t.Errorf("durationInRange() panic = %v, want a panic: %t", r, tt.wantPanic)
+				}
+			}()
+			got := durationInRange(prefix, "INTERVAL", 5*time.Second, time.Second, time.Hour)
+			if got != tt.want {
+				t.Errorf("durationInRange() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDurationRanges(t *testing.T) {
+	const day = 24 * time.Hour
+	influx := map[string]string{"DRY_RUN": "false", "INFLUX_SERVER_URL": "http://127.0.0.1:1", "INFLUX_SERVER_TOKEN": "token",
+		"INFLUX_SERVER_ORG": "org", "INFLUX_SERVER_BUCKET": "bucket", "INFLUX_HEALTH_CHECK": "none"}
+	tests := []struct {
+		name     string
+		min, max time.Duration
+		env      map[string]string // on top of a dry run of place 1001
+		got      func(w *watcher.Watcher, cli cliConfig) time.Duration
+	}{
+		{name: "POLL_INTERVAL", min: time.Second, max: 31 * day, got: func(w *watcher.Watcher, _ cliConfig) time.Duration { return w.PollInterval }},
+		{name: "INVOCATION_TIMEOUT", min: time.Second, max: day, got: func(w *watcher.Watcher, _ cliConfig) time.Duration { return w.Timeout }},
+		{name: "STARTUP_DELAY", min: 0, max: day, got: func(_ *watcher.Watcher, cli cliConfig) time.Duration { return cli.startupDelay }},
+		{name: "MAX_CLOCK_SKEW", min: time.Second, max: 3650 * day, got: func(w *watcher.Watcher, _ cliConfig) time.Duration { return w.MaxClockSkew }},
+		{name: "DRY_RUN_DIFF_RANGE", min: time.Hour, max: 3650 * day, got: func(w *watcher.Watcher, _ cliConfig) time.Duration { return w.DryRunDiffRange }},
+		{name: "HTTP_IDLE_CONN_TIMEOUT", min: 0, max: day, got: func(w *watcher.Watcher, _ cliConfig) time.Duration { return w.HTTPIdleConnTimeout }},
+		{name: "DAEMON_MAX_LIFETIME", min: 0, max: 3650 * day, got: func(w *watcher.Watcher, _ cliConfig) time.Duration { return w.MaxLifetime }},
+		{name: "METRICS_TRIGGER_MIN_INTERVAL", min: 0, max: day, got: func(w *watcher.Watcher, _ cliConfig) time.Duration { return w.HTTPTriggerMinInterval }},
+		{name: "RUNTIME_STATS_INTERVAL", min: 0, max: day, got: func(w *watcher.Watcher, _ cliConfig) time.Duration { return w.RuntimeStatsInterval }},
+		{name: "WRITE_RETRY_BACKOFF", min: 0, max: day, got: func(w *watcher.Watcher, _ cliConfig) time.Duration { return w.WriteRetryBackoff }},
+		{name: "POST_RUN_TIMEOUT", min: time.Second, max: day, got: func(w *watcher.Watcher, _ cliConfig) time.Duration { return w.PostRunTimeout }},
+		{name: "OVERLOAD_ALERT_COOLDOWN", min: 0, max: 31 * day, got: func(w *watcher.Watcher, _ cliConfig) time.Duration { return w.OverloadAlertCooldown }},
+		{name: "INFLUX_HEALTHCHECK_INTERVAL", min: 0, max: day, env: influx}, // only used while starting up
+	}
+	for _, tt := range tests {
+		for _, value := range []time.Duration{tt.min, tt.max, tt.min - time.Second, tt.max + time.Second} {
+			t.Run(fmt.Sprint(tt.name, "=", value), func(t *testing.T) {
+				t.Setenv("CONFIG_PREFIX", "FW_TEST_")
+				t.Setenv("FW_TEST_FOXPOST_PLACE_IDS", "1001")
+				t.Setenv("FW_TEST_DRY_RUN", "true")
+				for key, v := range tt.env {
+					t.Setenv("FW_TEST_"+key, v)
+				}
+				t.Setenv("FW_TEST_"+tt.name, value.String())
+
+				wantPanic := ""
+				if value < tt.min || value > tt.max {
+					wantPanic = fmt.Sprintf("invalid %s: %s is not between %s and %s", tt.name, value, tt.min, tt.max)
+				}
+				defer func() {
+					r := recover()
+					if (r != nil) != (wantPanic != "") || r != nil && fmt.Sprint(r) != wantPanic {
+						t.Errorf("loadConfig() panic = %v, want %q", r, wantPanic)
+					}
+				}()
+				w, cli := loadConfig()
+				if tt.got != nil && tt.got(w, cli) != value {
+					t.Errorf("%s = %s, want %s", tt.name, tt.got(w, cli), value)
+				}
+			})
+		}
+	}
+}
+
+func TestBackoffMap(t *testing.T) {
+	tests := []struct {
+		name string
+		want retryablehttp.Backoff
+	}{
+		{name: "", want: nil},
+		{name: "linear", want: retryablehttp.LinearJitterBackoff},
+		{name: "exponential", want: retryablehttp.DefaultBackoff},
+		{name: "exponential-jitter", want: watcher.ExponentialJitterBackoff},
+	}
+	for _, tt := range tests {
+		got, ok := backoffMap[tt.name]
+		if !ok {
+			t.Errorf("HTTP_BACKOFF=%q is not accepted", tt.name)
+			continue
+		}
+		if (got == nil) != (tt.want == nil) || got != nil && reflect.ValueOf(got).Pointer() != reflect.ValueOf(tt.want).Pointer() {
+			t.Errorf("HTTP_BACKOFF=%q selects the wrong backoff", tt.name)
+		}
+	}
+	if _, ok := backoffMap["fibonacci"]; ok {
+		t.Error("an unknown HTTP_BACKOFF is accepted")
+	}
+}
+
+func TestNewInfluxClientGzip(t *testing.T) {
+	for _, gzipped := range []bool{false, true} {
+		t.Run(fmt.Sprint("gzip=", gzipped), func(t *testing.T) {
+			var encoding, body string
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				encoding = r.Header.Get("Content-Encoding")
+				var reader io.Reader = r.Body
+				if encoding == "gzip" {
+					gz, err := gzip.NewReader(r.Body)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					reader = gz
+				}
+				b, _ := io.ReadAll(reader)
+				body = string(b)
+				rw.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+
+			t.Setenv("FW_TEST_INFLUX_SERVER_URL", srv.URL)
+			t.Setenv("FW_TEST_INFLUX_SERVER_TOKEN", "token")
+			t.Setenv("FW_TEST_INFLUX_HEALTH_CHECK", "none")
+			t.Setenv("FW_TEST_INFLUX_WRITE_GZIP", strconv.FormatBool(gzipped))
+			client, err := newInfluxClient(envPrefix("FW_TEST_"), time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			err = client.WriteAPIBlocking("org", "bucket").WriteRecord(context.Background(), "foxpost load=10u 1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (encoding == "gzip") != gzipped {
+				t.Errorf("Content-Encoding = %q with INFLUX_WRITE_GZIP=%t", encoding, gzipped)
+			}
+			if body != "foxpost load=10u 1\n" {
+				t.Errorf("body = %q", body)
+			}
+		})
+	}
+}
+
+// flakyInflux fails the first writes with statuses, then stores the lines
+type flakyInflux struct {
+	mu       sync.Mutex
+	statuses []int
+	requests int
+	lines    []string
+}
+
+func (f *flakyInflux) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if f.requests <= len(f.statuses) {
+		rw.Header().Set("Retry-After", "5")
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(f.statuses[f.requests-1])
+		_, _ = rw.Write([]byte(`{"code":"unavailable","message":"try later"}`))
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		if line != "" {
+			f.lines = append(f.lines, line)
+		}
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func TestTransientWriteErrors(t *testing.T) {
+	apms := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte(`[{"place_id": 1001, "name": "Alpha", "load": "overloaded"}, {"place_id": 1002, "name": "Beta", "load": ""}]`))
+	}))
+	defer apms.Close()
+
+	tests := []struct {
+		name      string
+		statuses  []int
+		cfg       watcher.Config
+		wantErr   bool
+		wantLines int
+	}{
+		{
+			name:      "retried",
+			statuses:  []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+			cfg:       watcher.Config{WriteBatchSize: 10, WriteRetries: 2, WriteRetryBackoff: 50 * time.Millisecond},
+			wantLines: 2,
+		},
+		{
+			name:     "out of retries",
+			statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			cfg:      watcher.Config{WriteBatchSize: 10, WriteRetries: 1, WriteRetryBackoff: 50 * time.Millisecond},
+			wantErr:  true,
+		},
+		{
+			// the write after the tolerated failure has to reach InfluxDB
+			name:      "tolerated",
+			statuses:  []int{http.StatusServiceUnavailable},
+			cfg:       watcher.Config{WriteBatchSize: 1, MaxWriteErrors: 1},
+			wantLines: 1, // within MAX_WRITE_ERRORS, so the run succeeds
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			influx := &flakyInflux{statuses: tt.statuses}
+			srv := httptest.NewServer(influx)
+			defer srv.Close()
+
+			t.Setenv("FW_TEST_INFLUX_SERVER_URL", srv.URL)
+			t.Setenv("FW_TEST_INFLUX_SERVER_TOKEN", "token")
+			t.Setenv("FW_TEST_INFLUX_HEALTH_CHECK", "none")
+			client, err := newInfluxClient(envPrefix("FW_TEST_"), time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			cfg := tt.cfg
+			cfg.PlaceIDs = []uint64{1001, 1002}
+			cfg.APMsURLs = []string{apms.URL}
+			cfg.InfluxClient = client
+			cfg.InfluxOrg = "org"
+			cfg.InfluxBucket = "bucket"
+			cfg.InfluxPrecision = time.Second
+			w, err := watcher.New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.RunOnce()
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RunOnce() error = %v, want an error: %t", err, tt.wantErr)
+			}
+			influx.mu.Lock()
+			defer influx.mu.Unlock()
+			if len(influx.lines) != tt.wantLines {
+				t.Errorf("%d lines stored after %d requests, want %d", len(influx.lines), influx.requests, tt.wantLines)
+			}
+		})
+	}
+}
+
+func TestValidateBucket(t *testing.T) {
+	tests := []struct {
+		name        string
+		bucketOrg   string
+		writeStatus int
+		wantErr     string // no error if empty
+	}{
+		{name: "valid", bucketOrg: "o1", writeStatus: http.StatusNoContent},
+		{name: "other org", bucketOrg: "o2", writeStatus: http.StatusNoContent, wantErr: "does not belong to org"},
+		{name: "read-only token", bucketOrg: "o1", writeStatus: http.StatusForbidden, wantErr: "the token may be read-only"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				rw.Header().Set("Content-Type", "application/json")
+				switch r.URL.Path {
+				case "/api/v2/orgs":
+					_, _ = rw.Write([]byte(`{"orgs": [{"id": "o1", "name": "org"}]}`))
+				case "/api/v2/buckets":
+					_, _ = fmt.Fprintf(rw, `{"buckets": [{"id": "b1", "name": "bucket", "orgID": %q, "retentionRules": []}]}`, tt.bucketOrg)
+				case "/api/v2/write":
+					rw.WriteHeader(tt.writeStatus)
+					if tt.writeStatus != http.StatusNoContent {
+						_, _ = rw.Write([]byte(`{"code": "forbidden", "message": "insufficient permissions for write"}`))
+					}
+				default:
+					http.NotFound(rw, r)
+				}
+			}))
+			defer srv.Close()
+			client := influxdb2.NewClientWithOptions(srv.URL, "token", influxdb2.DefaultOptions().SetMaxRetries(0))
+			defer client.Close()
+
+			err := validateBucket(context.Background(), client, "org", "bucket")
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateBucket() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gitlab.com/MikeTTh/env"
+	"log"
+)
+
+// validate loads the config (which also checks InfluxDB as set by INFLUX_HEALTH_CHECK), fetches the APM data once and checks that the
+// configured places are present in it. Nothing is written. Returns whether every step passed.
+func validate() (passed bool) {
+	log.Println("Validating config and connectivity...")
+	results := make([]string, 0, 3)
+	defer func() {
+		if r := recover(); r != nil {
+			results = append(results, fmt.Sprintf("FAIL %v", r))
+			passed = false
+		}
+		log.Println("Validation summary:")
+		for _, result := range results {
+			log.Println("  ", result)
+		}
+		if passed {
+			log.Println("Validation PASSED")
+		} else {
+			log.Println("Validation FAILED")
+		}
+	}()
+
+	w, _ := loadConfig() // panics on invalid config or failing InfluxDB check
+	results = append(results, "PASS config")
+	if w.DryRun {
+		results = append(results, "SKIP influxdb (dry run)")
+	} else {
+		results = append(results, "PASS influxdb "+envPrefix(env.String("CONFIG_PREFIX", "")).String("INFLUX_HEALTH_CHECK", "health"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
+	defer cancel()
+
+	checks, passed := w.Check(ctx)
+	results = append(results, checks...)
+	return passed
+}
@@ -0,0 +1,127 @@
+package watcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// overloadAlert fires when the ratio of the overloaded watched places crosses OverloadRatioThreshold, and recovers
+// when it drops back below. Logged (and sent to Telegram, if set up), repeated every OverloadAlertCooldown while firing
+// (if set).
+type overloadAlert struct {
+	mu        sync.Mutex
+	firing    bool
+	firedAt   time.Time
+	stateFile string // the state is saved to it on every change (if set), so the cooldown survives restarts
+}
+
+// alertState is the saved state of the alert
+type alertState struct {
+	Firing  bool      `json:"firing"`
+	FiredAt time.Time `json:"fired_at"`
+}
+
+// load restores the state saved to stateFile by a previous run, a missing file is not an error
+func (a *overloadAlert) load() error {
+	data, err := os.ReadFile(a.stateFile) // #nosec G304 -- path comes from the operator
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state alertState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return fmt.Errorf("invalid alert state: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.firing, a.firedAt = state.Firing, state.FiredAt
+	return nil
+}
+
+// save writes the state to stateFile (if set) through a temporary file, so a crash never leaves half of it behind.
+// Failures are only logged, the alert goes on from memory. Must be called with mu held.
+func (a *overloadAlert) save() {
+	if a.stateFile == "" {
+		return
+	}
+	data, err := json.Marshal(alertState{Firing: a.firing, FiredAt: a.firedAt})
+	if err != nil {
+		log.Println("Could not save the alert state: ", err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(a.stateFile), filepath.Base(a.stateFile)+".*.tmp")
+	if err != nil {
+		log.Println("Could not save the alert state: ", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	err = errors.Join(err, tmp.Close())
+	if err == nil {
+		err = os.Rename(tmp.Name(), a.stateFile)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		log.Println("Could not save the alert state: ", err)
+	}
+}
+
+// check returns the message to send if the alert fired or recovered, empty otherwise
+func (a *overloadAlert) check(threshold float64, cooldown time.Duration, matched int, overloaded []APMData) string {
+	if matched == 0 {
+		return "" // nothing to compare to
+	}
+	ratio := float64(len(overloaded)) / float64(matched)
+	overloadedIDs := make([]uint64, len(overloaded))
+	for i, apmData := range overloaded {
+		overloadedIDs[i] = apmData.PlaceID
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if ratio < threshold {
+		if a.firing {
+			message := fmt.Sprintf("RECOVERED: %.0f%% of the watched places are overloaded (%d of %d), below the %.0f%% threshold",
+				ratio*100, len(overloaded), matched, threshold*100)
+			log.Print(message)
+			a.firing = false
+			a.save()
+			return message
+		}
+		return ""
+	}
+
+	if a.firing && (cooldown == 0 || time.Since(a.firedAt) < cooldown) {
+		return ""
+	}
+	message := fmt.Sprintf("ALERT: %.0f%% of the watched places are overloaded (%d of %d), reaching the %.0f%% threshold",
+		ratio*100, len(overloaded), matched, threshold*100)
+	log.Printf("%s: %v", message, overloadedIDs)
+	a.firing = true
+	a.firedAt = time.Now()
+	a.save()
+
+	// the ids mean little in a chat, so the places are listed by their name, linked on the map
+	lines := []string{message + ":"}
+	for _, apmData := range overloaded {
+		lines = append(lines, fmt.Sprintf("%s %s", apmData.Name, mapsLink(apmData.GeoLat, apmData.GeoLng)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (a *overloadAlert) isFiring() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.firing
+}
@@ -0,0 +1,251 @@
+package watcher
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// https://foxpost.hu/uzleti-partnereknek/integracios-segedlet/webapi-integracio#api-4
+type APMData struct {
+	// we only interested in these fields
+	PlaceID    uint64  `json:"place_id"`
+	OperatorID string  `json:"operator_id"`
+	Name       string  `json:"name"`
+	GeoLat     float64 `json:"geolat"`
+	GeoLng     float64 `json:"geolng"`
+	Load       string  `json:"load"`
+	City       string  `json:"city"`
+	Zip        string  `json:"zip"`
+	Address    string  `json:"address"`
+	// the keys of the APM not decoded into the fields above, only captured with ExtraFields set
+	Extra map[string]interface{} `json:"-"`
+}
+
+var loadMap = map[string]uint8{
+	// not sure if those two are the same, but they appear similar on the map
+	"":              10,
+	"normal loaded": 10,
+	"medium loaded": 70,
+	"overloaded":    100,
+}
+
+// apmDecoder decodes the APMs with the decoding options of a Watcher. The zero value decodes them as they are.
+type apmDecoder struct {
+	fieldMap       map[string]string // maps the json keys of APMData to alternative ones used by the payload
+	validateSchema bool              // check every APM against the schema
+	captureExtras  bool              // keep the unknown keys of every APM in APMData.Extra
+	// makes sure every missing mapped field is logged only once, not for every APM
+	warnedMissingFields sync.Map
+}
+
+// plain tells whether the APMs can be decoded right into APMData, without looking at their keys
+func (d *apmDecoder) plain() bool {
+	return len(d.fieldMap) == 0 && !d.validateSchema && !d.captureExtras
+}
+
+//go:embed apmschema.json
+var apmSchemaJSON []byte
+
+// apmSchema lists the keys the watcher relies on and their JSON types, a subset check of the APM data
+type apmSchema struct {
+	Version  int                 `json:"version"`
+	Required map[string][]string `json:"required"`
+}
+
+var apmSchemaRules = func() apmSchema {
+	var schema apmSchema
+	err := json.Unmarshal(apmSchemaJSON, &schema)
+	if err != nil {
+		panic("invalid embedded APM schema: " + err.Error())
+	}
+	return schema
+}()
+
+// jsonType names the type of the JSON value
+func jsonType(value json.RawMessage) string {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 {
+		return "null"
+	}
+	switch value[0] {
+	case '"':
+		return "string"
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	default:
+		return "number"
+	}
+}
+
+// check returns an error for the first missing or mistyped key, in key order
+func (s apmSchema) check(raw map[string]json.RawMessage) error {
+	keys := make([]string, 0, len(s.Required))
+	for key := range s.Required {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		value, ok := raw[key]
+		if !ok {
+			return fmt.Errorf("schema v%d: %s is missing", s.Version, key)
+		}
+		if t := jsonType(value); !slices.Contains(s.Required[key], t) {
+			return fmt.Errorf("schema v%d: %s is %s instead of %s", s.Version, key, t, strings.Join(s.Required[key], " or "))
+		}
+	}
+	return nil
+}
+
+// apmDataKeys are the json keys decoded into the fields of APMData
+var apmDataKeys = func() []string {
+	var keys []string
+	t := reflect.TypeOf(APMData{})
+	for i := 0; i < t.NumField(); i++ {
+		if key, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); key != "" && key != "-" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}()
+
+// apmDataAlias has no methods, so it can be decoded without recursing into APMData.UnmarshalJSON
+type apmDataAlias APMData
+
+// placeID accepts both numbers and quoted strings, as some endpoints quote the ids
+type placeID uint64
+
+func (id *placeID) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	if len(data) >= 2 && data[0] == '"' && data[len(data)-1] == '"' {
+		data = data[1 : len(data)-1]
+	}
+	v, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid place_id %s: %w", data, err)
+	}
+	*id = placeID(v)
+	return nil
+}
+
+// decodeAPMData decodes into a, with the place id shadowed by the more tolerant placeID
+func decodeAPMData(data []byte, a *APMData) error {
+	decoded := struct {
+		*apmDataAlias
+		PlaceID placeID `json:"place_id"`
+	}{apmDataAlias: (*apmDataAlias)(a), PlaceID: placeID(a.PlaceID)}
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+	a.PlaceID = uint64(decoded.PlaceID)
+	return nil
+}
+
+func (a *APMData) UnmarshalJSON(data []byte) error {
+	return decodeAPMData(data, a)
+}
+
+// decode decodes a single APM into a
+func (d *apmDecoder) decode(data []byte, a *APMData) error {
+	if d.plain() {
+		return decodeAPMData(data, a)
+	}
+
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	remapped := make(map[string]json.RawMessage, len(raw))
+	for k, v := range raw {
+		remapped[k] = v
+	}
+	for field, key := range d.fieldMap {
+		value, ok := raw[key]
+		if !ok {
+			if _, warned := d.warnedMissingFields.LoadOrStore(key, true); !warned {
+				log.Printf("WARNING: field %s is missing from the APM data (mapped from %s), did the API change?", key, field)
+			}
+			continue
+		}
+		remapped[field] = value
+	}
+	if d.validateSchema {
+		err = apmSchemaRules.check(remapped)
+		if err != nil {
+			return fmt.Errorf("APM (place_id %s) does not match the schema: %w", remapped["place_id"], err)
+		}
+	}
+
+	if d.captureExtras {
+		a.Extra = map[string]interface{}{}
+		mapped := d.mappedKeys()
+		for key, value := range raw {
+			if slices.Contains(apmDataKeys, key) || slices.Contains(mapped, key) {
+				continue
+			}
+			var v interface{}
+			err = json.Unmarshal(value, &v)
+			if err != nil {
+				return err
+			}
+			a.Extra[key] = v
+		}
+	}
+
+	data, err = json.Marshal(remapped)
+	if err != nil {
+		return err
+	}
+	return decodeAPMData(data, a)
+}
+
+// decodeAll decodes a JSON array of APMs
+func (d *apmDecoder) decodeAll(data []byte) ([]APMData, error) {
+	var apmsData []APMData
+	if d.plain() {
+		err := json.Unmarshal(data, &apmsData)
+		return apmsData, err
+	}
+
+	var raws []json.RawMessage
+	err := json.Unmarshal(data, &raws)
+	if err != nil {
+		return nil, err
+	}
+	apmsData = make([]APMData, len(raws))
+	for i, raw := range raws {
+		err = d.decode(raw, &apmsData[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return apmsData, nil
+}
+
+// mappedKeys are the json keys of the payload decoded into the fields of APMData through the field map
+func (d *apmDecoder) mappedKeys() []string {
+	keys := make([]string, 0, len(d.fieldMap))
+	for _, key := range d.fieldMap {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,103 @@
+package watcher
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+// redacted replaces the secrets in the effective config
+const redacted = "[redacted]"
+
+// secretConfigFields are never shown, only whether they are set
+var secretConfigFields = map[string]bool{
+	"HTTPAuthPass":     true,
+	"HTTPTLSCert":      true, // holds the private key
+	"TelegramBotToken": true,
+	"RequestBody":      true, // the partner endpoints take their credentials in it
+	"PostRunCommand":   true, // may hold credentials on its command line
+}
+
+// redactURL hides the password of the urls carrying credentials
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// effectiveConfig describes the config the watcher runs with (after the defaults were filled in), with the secrets
+// redacted. Fields that can't be shown as JSON (functions, clients) are described instead.
+func (w *Watcher) effectiveConfig() map[string]interface{} {
+	cfg := w.Config
+	cfg.InfluxClient = w.influxClient()
+
+	v := reflect.ValueOf(cfg)
+	t := v.Type()
+	out := make(map[string]interface{}, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		field := v.Field(i)
+
+		switch {
+		case secretConfigFields[name]:
+			if field.IsZero() {
+				out[name] = nil
+			} else {
+				out[name] = redacted
+			}
+		case name == "InfluxClient":
+			if cfg.InfluxClient == nil {
+				out[name] = nil
+			} else {
+				out[name] = map[string]string{"ServerURL": redactURL(cfg.InfluxClient.ServerURL()), "Token": redacted}
+			}
+		case name == "APMsURLs":
+			urls := make([]string, len(cfg.APMsURLs))
+			for i, u := range cfg.APMsURLs {
+				urls[i] = redactURL(u)
+			}
+			out[name] = urls
+		case name == "DetailURLTemplate":
+			out[name] = redactURL(cfg.DetailURLTemplate)
+		case name == "LoadBands":
+			// the thresholds are numbers, not bytes, so they are not shown as base64
+			bands := cfg.LoadBands
+			if len(bands) == 0 {
+				bands = []uint8{loadMap["medium loaded"], loadMap["overloaded"]} // the default, even if unused
+			}
+			thresholds := make([]int, len(bands))
+			for i, band := range bands {
+				thresholds[i] = int(band)
+			}
+			out[name] = thresholds
+		case field.Kind() == reflect.Func || field.Kind() == reflect.Interface || field.Kind() == reflect.Pointer:
+			out[name] = !field.IsNil() // only tell whether it is set
+		case field.Type() == reflect.TypeOf(time.Duration(0)):
+			out[name] = time.Duration(field.Int()).String()
+		default:
+			out[name] = field.Interface()
+		}
+	}
+
+	// the numeric semantics of the load, which are not configurable, but needed to make sense of the numbers
+	out["LoadMap"] = loadMap
+	out["LoadCodes"] = loadCodes
+	out["OverloadAlertFiring"] = w.overloadAlert.isFiring()
+	return out
+}
+
+// configHandler serves the effective config as JSON
+func configHandler(wt *Watcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(wt.effectiveConfig())
+		if err != nil {
+			log.Println("Could not encode the config: ", err)
+		}
+	})
+}
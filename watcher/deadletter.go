@@ -0,0 +1,142 @@
+package watcher
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/api/write"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// appendDeadLetters appends the line protocol of the points that failed to write to path, after a comment line
+// holding the time, the bucket they were written to (when bucketOf is set) and the error. The caller serializes the
+// appends.
+func appendDeadLetters(path string, points []*write.Point, bucketOf func(*write.Point) string, precision time.Duration, writeErr error) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600) // #nosec G304 -- path comes from the operator
+	if err != nil {
+		return err
+	}
+
+	// group the points by bucket, a comment line before each group
+	var buckets []string
+	byBucket := map[string][]*write.Point{}
+	for _, point := range points {
+		bucket := ""
+		if bucketOf != nil {
+			bucket = bucketOf(point)
+		}
+		if _, ok := byBucket[bucket]; !ok {
+			buckets = append(buckets, bucket)
+		}
+		byBucket[bucket] = append(byBucket[bucket], point)
+	}
+
+	var sb strings.Builder
+	// keep the error on a single line, so it stays a single comment
+	errText := strings.ReplaceAll(writeErr.Error(), "\n", " ")
+	now := time.Now().Format(time.RFC3339)
+	for _, bucket := range buckets {
+		if bucket == "" {
+			sb.WriteString(fmt.Sprintf("# %s %s\n", now, errText))
+		} else {
+			sb.WriteString(fmt.Sprintf("# %s bucket=%s %s\n", now, strconv.Quote(bucket), errText))
+		}
+		for _, point := range byBucket[bucket] {
+			line, err := lineProtocol(point, precision)
+			if err != nil {
+				// can't be replayed anyway, but keep a trace of it
+				sb.WriteString(fmt.Sprintf("# could not encode a point of %s: %s\n", point.Name(), err))
+				continue
+			}
+			sb.WriteString(line) // ends with a newline
+		}
+	}
+	_, err = f.WriteString(sb.String())
+	return errors.Join(err, f.Close())
+}
+
+// deadLetterBucket tells the bucket in a comment line of the dead-letter file, empty if it has none
+func deadLetterBucket(comment string) string {
+	_, rest, ok := strings.Cut(strings.TrimPrefix(comment, "# "), " ")
+	if !ok || !strings.HasPrefix(rest, "bucket=") {
+		return ""
+	}
+	quoted, err := strconv.QuotedPrefix(strings.TrimPrefix(rest, "bucket="))
+	if err != nil {
+		return ""
+	}
+	bucket, _ := strconv.Unquote(quoted)
+	return bucket
+}
+
+// ReplayDeadLetters writes the points of the DeadLetterFile to InfluxDB, to the bucket they were meant for, then empties
+// the file.
+// Nothing is removed if any of the writes fail. Returns the number of points written.
+func (w *Watcher) ReplayDeadLetters(ctx context.Context) (int, error) {
+	client := w.influxClient()
+	if client == nil {
+		return 0, errors.New("replaying dead letters: no InfluxDB client (dry run or OUTPUT=udp)")
+	}
+
+	w.deadLetterMu.Lock()
+	defer w.deadLetterMu.Unlock()
+
+	f, err := os.Open(w.DeadLetterFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// the lines by bucket, the ones without a bucket in their comment line go to InfluxBucket
+	var buckets []string
+	byBucket := map[string][]string{}
+	total := 0
+	bucket := w.InfluxBucket
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			bucket = deadLetterBucket(line)
+			if bucket == "" {
+				bucket = w.InfluxBucket
+			}
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if _, ok := byBucket[bucket]; !ok {
+			buckets = append(buckets, bucket)
+		}
+		byBucket[bucket] = append(byBucket[bucket], line)
+		total++
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+	if total == 0 {
+		return 0, nil
+	}
+
+	replayed := 0
+	for _, bucket := range buckets {
+		lines := byBucket[bucket]
+		writeAPI := client.WriteAPIBlocking(w.InfluxOrg, bucket)
+		for start := 0; start < len(lines); start += w.WriteBatchSize {
+			end := min(start+w.WriteBatchSize, len(lines))
+			err = writeAPI.WriteRecord(ctx, lines[start:end]...)
+			if err != nil {
+				return replayed, fmt.Errorf("replaying dead letters to bucket %s: %w", bucket, err)
+			}
+			replayed += end - start
+			log.Printf("Replayed %d of %d dead letters", replayed, total)
+		}
+	}
+
+	return total, os.Truncate(w.DeadLetterFile, 0)
+}
@@ -0,0 +1,95 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-retryablehttp"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fetchDetails downloads the detail of each watched place present in the APM data, at most EnrichConcurrency at once.
+// Returns the selected EnrichFields of each place as fields prefixed by detail_. Failing places are only logged.
+func fetchDetails(ctx context.Context, w *Watcher, apmsData []APMData) map[uint64]map[string]interface{} {
+	cl := w.newHTTPClient()
+	cl.RetryMax = 1 // don't hammer the API, the detail is optional anyway
+
+	var mu sync.Mutex
+	details := make(map[uint64]map[string]interface{})
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, w.EnrichConcurrency)
+	for _, apmData := range apmsData {
+		if !w.watches(apmData) {
+			continue
+		}
+		placeID := apmData.PlaceID
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			fields, err := fetchDetail(ctx, cl, w, placeID)
+			if err != nil {
+				log.Printf("Could not fetch the detail of place %d: %s", placeID, err)
+				return
+			}
+			mu.Lock()
+			details[placeID] = fields
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return details
+}
+
+func fetchDetail(ctx context.Context, cl *retryablehttp.Client, w *Watcher, placeID uint64) (map[string]interface{}, error) {
+	url := strings.ReplaceAll(w.DetailURLTemplate, "{place_id}", strconv.FormatUint(placeID, 10))
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cl.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status: %d", resp.StatusCode)
+	}
+
+	var detail map[string]interface{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, w.MaxResponseBytes)).Decode(&detail)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]interface{}, len(w.EnrichFields))
+	for _, key := range w.EnrichFields {
+		value, ok := detail[key]
+		if !ok || value == nil {
+			continue
+		}
+		switch value.(type) {
+		case float64, string, bool:
+		default:
+			// objects and arrays (e.g. the list of services) are stored as they were
+			raw, _ := json.Marshal(value)
+			value = string(raw)
+		}
+		fields["detail_"+key] = value
+	}
+	return fields, nil
+}
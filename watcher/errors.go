@@ -0,0 +1,105 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+)
+
+// RunErrorKind classifies why a run failed
+type RunErrorKind int
+
+const (
+	RunErrorFetch       RunErrorKind = iota // downloading the APM data failed
+	RunErrorDecode                          // the APM data could not be parsed
+	RunErrorWrite                           // writing the points failed
+	RunErrorConfig                          // the config does not work (e.g. invalid url)
+	RunErrorTimeout                         // the run exceeded INVOCATION_TIMEOUT
+	RunErrorHook                            // the post-run command failed (with POST_RUN_FAIL_RUN)
+	RunErrorUnreachable                     // the output could not be reached (or was unavailable), even after the retries
+)
+
+func (k RunErrorKind) String() string {
+	switch k {
+	case RunErrorFetch:
+		return "fetch"
+	case RunErrorDecode:
+		return "decode"
+	case RunErrorWrite:
+		return "write"
+	case RunErrorConfig:
+		return "config"
+	case RunErrorTimeout:
+		return "timeout"
+	case RunErrorHook:
+		return "hook"
+	case RunErrorUnreachable:
+		return "unreachable"
+	default:
+		return "unknown"
+	}
+}
+
+// RunError is returned by run, so failures can be told apart without string matching
+type RunError struct {
+	Kind RunErrorKind
+	Err  error
+}
+
+// newRunError wraps err, running out of time overrides the given kind as it can happen at any phase. It is told by
+// the error chain, or by ctx (the one the failed step ran with) being past its deadline, as some errors (e.g. the
+// ones of the influx client) don't wrap the context error.
+func newRunError(ctx context.Context, kind RunErrorKind, err error) *RunError {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		kind = RunErrorTimeout
+	}
+	return &RunError{Kind: kind, Err: err}
+}
+
+func (e *RunError) Error() string {
+	return e.Kind.String() + " error: " + e.Err.Error()
+}
+
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
+
+// runErrorKind returns the kind of err, errors not coming from run are classified as fetch errors
+func runErrorKind(err error) RunErrorKind {
+	var runErr *RunError
+	if errors.As(err, &runErr) {
+		return runErr.Kind
+	}
+	return RunErrorFetch
+}
+
+// writeErrorStatus returns the status code of a failed write to InfluxDB, zero if no response was received, -1 if the
+// error did not come from the client. Its error type is internal, so the code is looked up by reflection.
+func writeErrorStatus(err error) int {
+	for ; err != nil; err = errors.Unwrap(err) {
+		v := reflect.ValueOf(err)
+		if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			continue
+		}
+		if code := v.Elem().FieldByName("StatusCode"); code.IsValid() && code.Kind() == reflect.Int {
+			return int(code.Int())
+		}
+	}
+	return -1
+}
+
+// transientWriteError tells whether the write may succeed if retried: the output was unreachable, overloaded or
+// unavailable, unlike e.g. a rejected token or invalid points
+func transientWriteError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false // out of time, not the output's fault (and retrying would not help)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	code := writeErrorStatus(err)
+	return code == 0 || code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
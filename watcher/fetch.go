@@ -0,0 +1,250 @@
+package watcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-retryablehttp"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// apmsFetch is the result of a successful download of the APM data
+type apmsFetch struct {
+	apms   []APMData
+	ts     time.Time // time of the successful request
+	source string    // url the data was downloaded from
+	// the Last-Modified header of the response, zero if it was missing or invalid
+	lastModified time.Time
+	// time it took to read and decode the response body
+	decodeDuration time.Duration
+	// the LOG_RESPONSE_HEADERS present in the response, keyed by their canonical name
+	headers map[string]string
+}
+
+// fetchAPMs downloads and parses the APM data, trying each configured url in order until one succeeds
+func fetchAPMs(ctx context.Context, w *Watcher) (*apmsFetch, error) {
+	var errs []error
+	for _, url := range w.APMsURLs {
+		fetch, err := fetchAPMsFrom(ctx, w, url)
+		if err == nil {
+			if len(w.APMsURLs) > 1 {
+				log.Println("APM data served by", url)
+			}
+			return fetch, nil
+		}
+		if ctx.Err() != nil || len(w.APMsURLs) == 1 {
+			return nil, err // no time left to try the others (or there are no others)
+		}
+		log.Printf("Fetching from %s failed: %s", url, err)
+		errs = append(errs, fmt.Errorf("%s: %w", url, err))
+	}
+	// classify by the last one, tried as a final resort
+	return nil, newRunError(ctx, runErrorKind(errs[len(errs)-1]), errors.Join(errs...))
+}
+
+func fetchAPMsFrom(ctx context.Context, w *Watcher, url string) (*apmsFetch, error) {
+	var err error
+
+	cl := w.newHTTPClient()
+
+	responses := responseCounter{} // of this fetch, the ones since startup are kept by the stats
+	attempt := 0
+	cl.ResponseLogHook = func(_ retryablehttp.Logger, resp *http.Response) {
+		attempt++
+		w.HTTPLogger.Debug("response received", "url", url, "attempt", attempt, "status", resp.StatusCode)
+		responses[resp.StatusCode]++
+		w.stats.recordResponse(resp.StatusCode)
+		if w.HTTPListen != "" { // only bother with the metric when it is exposed
+			cdnResponsesTotal.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+		}
+	}
+
+	var req *retryablehttp.Request
+	var reqBody interface{} // a nil []byte would still be sent as an empty body
+	if w.RequestBody != "" {
+		reqBody = []byte(w.RequestBody) // read again by each retry
+	}
+	req, err = retryablehttp.NewRequestWithContext(ctx, w.HTTPMethod, url, reqBody)
+	if err != nil {
+		return nil, newRunError(ctx, RunErrorConfig, err)
+	}
+	if w.RequestBody != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	var resp *http.Response
+	resp, err = cl.Do(req)
+	if responses.total() > 1 {
+		log.Println("Responses received while retrying:", responses)
+	}
+	if err != nil {
+		return nil, newRunError(ctx, RunErrorFetch, err)
+	}
+	defer resp.Body.Close()
+
+	ts := time.Now() // record the time of the successful request
+
+	// this is "slipped" through the retrier
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRunError(ctx, RunErrorFetch, fmt.Errorf("unexpected HTTP status: %d", resp.StatusCode))
+	}
+
+	var headers map[string]string
+	if len(w.LogResponseHeaders) > 0 {
+		headers = make(map[string]string, len(w.LogResponseHeaders))
+		for _, name := range w.LogResponseHeaders {
+			if v := resp.Header.Get(name); v != "" {
+				headers[name] = v
+				log.Printf("Response header %s: %s", name, v)
+			}
+		}
+	}
+
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified")) // stays zero if missing or invalid
+
+	tooLargeErr := newRunError(ctx, RunErrorFetch, fmt.Errorf("response is larger than MAX_RESPONSE_BYTES (%d bytes)", w.MaxResponseBytes))
+	if resp.ContentLength > w.MaxResponseBytes {
+		return nil, tooLargeErr
+	}
+	// read one byte over the limit, so we can tell if it was exceeded
+	body := &io.LimitedReader{R: resp.Body, N: w.MaxResponseBytes + 1}
+
+	// cool and good, parse response
+	hasher := sha256.New()
+	decodeStart := time.Now()
+	apmsData, err := decodeAPMs(io.TeeReader(body, hasher), w.PayloadFormat, w.PayloadWrappedKey, w.decoder)
+	decodeDuration := time.Since(decodeStart) // the body is streamed, so this includes reading it too
+	if body.N <= 0 {
+		return nil, tooLargeErr // decoding likely failed because of the truncation
+	}
+	if err != nil {
+		return nil, newRunError(ctx, RunErrorDecode, err)
+	}
+	_, _ = io.Copy(hasher, body) // the decoder may stop before EOF, hash the rest too
+	if body.N <= 0 {
+		return nil, tooLargeErr
+	}
+
+	log.Printf("Decoded %d APMs in %s", len(apmsData), decodeDuration.Round(time.Millisecond))
+	decodeDurationGauge.Set(decodeDuration.Seconds())
+	decodedEntriesGauge.Set(float64(len(apmsData)))
+
+	var payloadHash [sha256.Size]byte
+	copy(payloadHash[:], hasher.Sum(nil))
+	w.dataChange.observe(lastModified, payloadHash, ts)
+
+	return &apmsFetch{
+		apms:           apmsData,
+		ts:             ts,
+		source:         url,
+		headers:        headers,
+		lastModified:   lastModified,
+		decodeDuration: decodeDuration,
+	}, nil
+}
+
+// decodeAPMs parses the APM data in the given PAYLOAD_FORMAT with the decoder
+func decodeAPMs(r io.Reader, format string, wrappedKey string, decoder *apmDecoder) ([]APMData, error) {
+	var apmsData []APMData
+	dec := json.NewDecoder(r)
+
+	switch format {
+	case "array":
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err != nil {
+			return nil, err
+		}
+		apmsData, err = decoder.decodeAll(raw)
+		if err != nil {
+			return nil, err
+		}
+
+	case "ndjson":
+		for {
+			var raw json.RawMessage
+			err := dec.Decode(&raw)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			var apmData APMData
+			err = decoder.decode(raw, &apmData)
+			if err != nil {
+				return nil, err
+			}
+			apmsData = append(apmsData, apmData)
+		}
+
+	case "wrapped":
+		var wrapper map[string]json.RawMessage
+		err := dec.Decode(&wrapper)
+		if err != nil {
+			return nil, err
+		}
+		raw, ok := wrapper[wrappedKey]
+		if !ok {
+			return nil, fmt.Errorf("key %s is missing from the wrapped payload", wrappedKey)
+		}
+		apmsData, err = decoder.decodeAll(raw)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown payload format: %s", format)
+	}
+
+	return apmsData, nil
+}
+
+// WarmUp sends a HEAD request to each configured url, to surface network issues right at startup.
+// Only fails if none of them are reachable.
+func (w *Watcher) WarmUp() error {
+	cl := w.newHTTPClient()
+	cl.RetryMax = 0
+	cl.Logger = nil // we log the outcome ourselves
+
+	var errs []error
+	for _, url := range w.APMsURLs {
+		err := func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+			if err != nil {
+				return err
+			}
+
+			start := time.Now()
+			resp, err := cl.Do(req)
+			if err != nil {
+				return err
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode >= 400 {
+				return fmt.Errorf("unexpected HTTP status: %d", resp.StatusCode)
+			}
+			log.Printf("Warm-up: %s is reachable (HTTP %d in %s)", url, resp.StatusCode, time.Since(start).Round(time.Millisecond))
+			return nil
+		}()
+		if err != nil {
+			log.Printf("Warm-up: %s is unreachable: %s", url, err)
+			errs = append(errs, fmt.Errorf("%s: %w", url, err))
+		}
+	}
+
+	if len(errs) == len(w.APMsURLs) {
+		return errors.Join(errs...) // no point going on if neither of them works
+	}
+	return nil
+}
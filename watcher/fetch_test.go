@@ -0,0 +1,202 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeAPMs(t *testing.T) {
+	alpha := APMData{PlaceID: 1001, OperatorID: "hu1001", Name: "Alpha", GeoLat: 47.5, GeoLng: 19.05, Load: "overloaded"}
+	beta := APMData{PlaceID: 1002, Name: "Beta", Load: "medium loaded"}
+	tests := []struct {
+		name       string
+		payload    string
+		format     string
+		wrappedKey string
+		decoder    *apmDecoder
+		want       []APMData
+		wantErr    bool
+	}{
+		{
+			name:    "array",
+			payload: `[{"place_id": 1001, "operator_id": "hu1001", "name": "Alpha", "geolat": 47.5, "geolng": 19.05, "load": "overloaded"}, {"place_id": 1002, "name": "Beta", "load": "medium loaded"}]`,
+			format:  "array",
+			want:    []APMData{alpha, beta},
+		},
+		{
+			name:    "empty array",
+			payload: `[]`,
+			format:  "array",
+			want:    []APMData{},
+		},
+		{
+			name:    "ndjson",
+			payload: "{\"place_id\": 1001, \"operator_id\": \"hu1001\", \"name\": \"Alpha\", \"geolat\": 47.5, \"geolng\": 19.05, \"load\": \"overloaded\"}\n\n{\"place_id\": 1002, \"name\": \"Beta\", \"load\": \"medium loaded\"}\n",
+			format:  "ndjson",
+			want:    []APMData{alpha, beta},
+		},
+		{
+			name:    "invalid ndjson line",
+			payload: "{\"place_id\": 1001}\n{\"place_id\": \n",
+			format:  "ndjson",
+			wantErr: true,
+		},
+		{
+			name:       "wrapped",
+			payload:    `{"version": 3, "data": [{"place_id": 1002, "name": "Beta", "load": "medium loaded"}]}`,
+			format:     "wrapped",
+			wrappedKey: "data",
+			want:       []APMData{beta},
+		},
+		{
+			name:       "wrapped without the key",
+			payload:    `{"items": []}`,
+			format:     "wrapped",
+			wrappedKey: "data",
+			wantErr:    true,
+		},
+		{
+			name:    "unknown format",
+			payload: `[]`,
+			format:  "xml",
+			wantErr: true,
+		},
+		{
+			name:    "not an array",
+			payload: `{"place_id": 1001}`,
+			format:  "array",
+			wantErr: true,
+		},
+		{
+			name:    "mapped fields",
+			payload: `[{"id": "1002", "title": "Beta", "load": "medium loaded"}]`,
+			format:  "array",
+			decoder: &apmDecoder{fieldMap: map[string]string{"place_id": "id", "name": "title"}},
+			want:    []APMData{beta},
+		},
+		{
+			name:    "extras",
+			payload: `[{"place_id": 1002, "name": "Beta", "load": "medium loaded", "open": true, "depth": 3}]`,
+			format:  "array",
+			decoder: &apmDecoder{captureExtras: true},
+			want:    []APMData{{PlaceID: 1002, Name: "Beta", Load: "medium loaded", Extra: map[string]interface{}{"open": true, "depth": 3.0}}},
+		},
+		{
+			name:    "valid schema",
+			payload: `[{"place_id": "1001", "operator_id": "hu1001", "name": "Alpha", "geolat": 47.5, "geolng": 19.05, "load": "overloaded"}]`,
+			format:  "array",
+			decoder: &apmDecoder{validateSchema: true},
+			want:    []APMData{alpha},
+		},
+		{
+			name:    "schema mismatch",
+			payload: `[{"place_id": 1001, "operator_id": "hu1001", "name": "Alpha", "geolat": "47.5", "geolng": 19.05, "load": "overloaded"}]`,
+			format:  "array",
+			decoder: &apmDecoder{validateSchema: true},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoder := tt.decoder
+			if decoder == nil {
+				decoder = &apmDecoder{}
+			}
+			got, err := decodeAPMs(strings.NewReader(tt.payload), tt.format, tt.wrappedKey, decoder)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("decodeAPMs() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) || len(got) > 0 && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeAPMs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeAPMsPlaceID(t *testing.T) {
+	tests := []struct {
+		name    string
+		placeID string // as in the json
+		want    uint64
+		wantErr bool
+	}{
+		{name: "number", placeID: `1001`, want: 1001},
+		{name: "string", placeID: `"1001"`, want: 1001},
+		{name: "max number", placeID: `18446744073709551615`, want: 18446744073709551615},
+		{name: "max string", placeID: `"18446744073709551615"`, want: 18446744073709551615},
+		{name: "null", placeID: `null`, want: 0},
+		{name: "overflow", placeID: `18446744073709551616`, wantErr: true},
+		{name: "negative", placeID: `-1`, wantErr: true},
+		{name: "fraction", placeID: `1001.5`, wantErr: true},
+		{name: "not a number", placeID: `"hu1001"`, wantErr: true},
+		{name: "empty string", placeID: `""`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// both the plain and the key aware path
+			for _, decoder := range []*apmDecoder{{}, {captureExtras: true}} {
+				got, err := decodeAPMs(strings.NewReader(`[{"place_id": `+tt.placeID+`}]`), "array", "", decoder)
+				if tt.wantErr {
+					if err == nil {
+						t.Errorf("place_id %s decoded to %d, want an error", tt.placeID, got[0].PlaceID)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got[0].PlaceID != tt.want {
+					t.Errorf("place_id %s decoded to %d, want %d", tt.placeID, got[0].PlaceID, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchResponseCounts(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		requests++
+		if requests == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = rw.Write([]byte(testAPMs))
+	}))
+	defer srv.Close()
+
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	// no METRICS_LISTEN, like a one-shot run
+	w := newTestWatcher(t, testAPMs, Config{HTTPBackoff: func(_, _ time.Duration, _ int, _ *http.Response) time.Duration {
+		return 0
+	}})
+	for i := 0; i < 2; i++ {
+		_, err := fetchAPMsFrom(context.Background(), w, srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !strings.Contains(logged.String(), "Responses received while retrying: 200=1 503=1\n") {
+		t.Errorf("the retries of the first fetch are not logged:\n%s", logged.String())
+	}
+	if got := w.stats.summary(); !strings.HasSuffix(got, ", responses 200=2 503=1") {
+		t.Errorf("summary %q does not hold the responses", got)
+	}
+}
@@ -0,0 +1,26 @@
+package watcher
+
+import (
+	"slices"
+	"strings"
+)
+
+// normalizeCity makes city names comparable regardless of case and spacing
+func normalizeCity(city string) string {
+	return strings.ToLower(strings.Join(strings.Fields(city), " "))
+}
+
+// watches tells whether the APM is a place of interest. It has to match every configured filter:
+// PlaceIDs, Cities and Zips (the ones left empty match everything).
+func (w *Watcher) watches(apmData APMData) bool {
+	if len(w.PlaceIDs) > 0 && !slices.Contains(w.PlaceIDs, apmData.PlaceID) {
+		return false
+	}
+	if len(w.Cities) > 0 && !slices.Contains(w.cities, normalizeCity(apmData.City)) {
+		return false
+	}
+	if len(w.Zips) > 0 && !slices.Contains(w.Zips, strings.TrimSpace(apmData.Zip)) {
+		return false
+	}
+	return true
+}
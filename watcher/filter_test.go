@@ -0,0 +1,45 @@
+package watcher
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestWatches(t *testing.T) {
+	apms := []APMData{
+		{PlaceID: 1001, City: "Budapest", Zip: "1011"},
+		{PlaceID: 1002, City: " budapest ", Zip: "1012 "},
+		{PlaceID: 1003, City: "Szeged", Zip: "6720"},
+		{PlaceID: 1004, City: "Székesfehérvár", Zip: "8000"},
+		{PlaceID: 1005, City: "", Zip: ""},
+	}
+	tests := []struct {
+		name string
+		cfg  Config
+		want []uint64
+	}{
+		{name: "place ids", cfg: Config{PlaceIDs: []uint64{1001, 1003}}, want: []uint64{1001, 1003}},
+		{name: "city", cfg: Config{Cities: []string{"BUDAPEST"}}, want: []uint64{1001, 1002}},
+		{name: "accented city", cfg: Config{Cities: []string{"székesfehérvár"}}, want: []uint64{1004}},
+		{name: "cities", cfg: Config{Cities: []string{"budapest", "Szeged"}}, want: []uint64{1001, 1002, 1003}},
+		{name: "zips", cfg: Config{Zips: []string{"1012", "8000"}}, want: []uint64{1002, 1004}},
+		{name: "city and zip", cfg: Config{Cities: []string{"Budapest"}, Zips: []string{"1011", "6720"}}, want: []uint64{1001}},
+		{name: "place ids and city", cfg: Config{PlaceIDs: []uint64{1001, 1003}, Cities: []string{"Szeged"}}, want: []uint64{1003}},
+		{name: "all three", cfg: Config{PlaceIDs: []uint64{1002, 1003}, Cities: []string{"Budapest"}, Zips: []string{"1012"}}, want: []uint64{1002}},
+		{name: "no match", cfg: Config{Cities: []string{"Debrecen"}}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestWatcher(t, "[]", tt.cfg)
+			var got []uint64
+			for _, apm := range apms {
+				if w.watches(apm) {
+					got = append(got, apm.PlaceID)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("watches %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package watcher
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// runSummary is an entry of the run history served at /runs
+type runSummary struct {
+	StartedAt       time.Time `json:"started_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Success         bool      `json:"success"`
+	Error           string    `json:"error,omitempty"`
+	Matched         int       `json:"matched"`
+	Overloaded      int       `json:"overloaded"`
+	PointsWritten   int       `json:"points_written"`
+	WriteRetries    int       `json:"write_retries"`
+}
+
+// runHistory keeps the summaries of the last runs in a ring buffer
+type runHistory struct {
+	mu      sync.Mutex
+	entries []runSummary
+	next    int // index of the oldest entry once the buffer is full
+}
+
+func newRunHistory(size int) *runHistory {
+	return &runHistory{entries: make([]runSummary, 0, size)}
+}
+
+func (h *runHistory) add(startedAt time.Time, res runResult, err error) {
+	summary := runSummary{
+		StartedAt:       startedAt,
+		DurationSeconds: time.Since(startedAt).Seconds(),
+		Success:         err == nil,
+		Matched:         res.matched,
+		Overloaded:      res.overloaded,
+		PointsWritten:   res.pointsWritten,
+		WriteRetries:    res.writeRetries,
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if cap(h.entries) == 0 {
+		return
+	}
+	if len(h.entries) < cap(h.entries) {
+		h.entries = append(h.entries, summary)
+		return
+	}
+	h.entries[h.next] = summary
+	h.next = (h.next + 1) % len(h.entries)
+}
+
+// list returns the summaries, the most recent first
+func (h *runHistory) list() []runSummary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	summaries := make([]runSummary, len(h.entries))
+	for i := range summaries {
+		// the newest one is right before next
+		summaries[i] = h.entries[(h.next-1-i+2*len(h.entries))%len(h.entries)]
+	}
+	return summaries
+}
+
+func runsHandler(history *runHistory) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(history.list())
+		if err != nil {
+			log.Println("Failed to encode /runs response: ", err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// postRunSummary is passed to the post-run command on its stdin
+type postRunSummary struct {
+	Matched       int       `json:"matched"`
+	Overloaded    int       `json:"overloaded"`
+	PointsWritten int       `json:"points_written"`
+	Time          time.Time `json:"time"`
+}
+
+// postRunWaitDelay is how long the post-run command may keep its output open after it was killed on its timeout
+const postRunWaitDelay = time.Second
+
+// runPostRunCommand runs POST_RUN_COMMAND with a summary of the run, both as env vars and as JSON on stdin
+func runPostRunCommand(w *Watcher, res runResult) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.PostRunTimeout)
+	defer cancel()
+
+	summary, err := json.Marshal(postRunSummary{
+		Matched:       res.matched,
+		Overloaded:    res.overloaded,
+		PointsWritten: res.pointsWritten,
+		Time:          time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", w.PostRunCommand) // #nosec G204 -- the command is configured by the operator
+	cmd.Stdin = bytes.NewReader(summary)
+	cmd.Env = append(os.Environ(),
+		"FOXPOST_MATCHED="+strconv.Itoa(res.matched),
+		"FOXPOST_OVERLOADED="+strconv.Itoa(res.overloaded),
+		"FOXPOST_POINTS_WRITTEN="+strconv.Itoa(res.pointsWritten),
+	)
+	// on the timeout, kill the children of the shell too, they would keep the output pipe (and so the run) waiting
+	killProcessGroup(cmd)
+	cmd.WaitDelay = postRunWaitDelay
+
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Printf("Post-run command output: %s", bytes.TrimSpace(out))
+	}
+	if err != nil {
+		return fmt.Errorf("post-run command: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package watcher
+
+import "os/exec"
+
+// killProcessGroup is a no-op without process groups, only the command itself is killed (and WaitDelay stops the wait)
+func killProcessGroup(*exec.Cmd) {}
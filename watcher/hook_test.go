@@ -0,0 +1,51 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPostRunCommandTimeout(t *testing.T) {
+	done := filepath.Join(t.TempDir(), "done")
+	w := &Watcher{Config: Config{
+		// the sleep is a child of the shell, holding the output pipe
+		PostRunCommand: "echo started; sleep 1; touch " + done,
+		PostRunTimeout: 100 * time.Millisecond,
+	}}
+
+	start := time.Now()
+	err := runPostRunCommand(w, runResult{})
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("the post-run command took %s, want it stopped at its timeout", elapsed)
+	}
+	if err == nil {
+		t.Error("runPostRunCommand() should fail on the timeout")
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if _, err = os.Stat(done); err == nil {
+		t.Error("the child of the post-run command kept running after the timeout")
+	}
+}
+
+func TestPostRunCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	w := &Watcher{Config: Config{
+		PostRunCommand: "cat > " + out + "; echo $FOXPOST_MATCHED >> " + out,
+		PostRunTimeout: 10 * time.Second,
+	}}
+	err := runPostRunCommand(w, runResult{matched: 2, overloaded: 1, pointsWritten: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const wantPrefix = `{"matched":2,"overloaded":1,"points_written":3,"time":`
+	if len(got) < len(wantPrefix) || string(got[:len(wantPrefix)]) != wantPrefix || string(got[len(got)-3:]) != "}2\n" {
+		t.Errorf("the post-run command got %q", got)
+	}
+}
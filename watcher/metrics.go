@@ -0,0 +1,230 @@
+package watcher
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dataChangeTracker remembers when the upstream data last changed.
+// Prefers the Last-Modified header, falls back to the time we first saw a new payload hash.
+type dataChangeTracker struct {
+	mu        sync.Mutex
+	lastHash  [sha256.Size]byte
+	changedAt time.Time
+}
+
+func (t *dataChangeTracker) observe(lastModified time.Time, hash [sha256.Size]byte, ts time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !lastModified.IsZero() {
+		t.changedAt = lastModified
+	} else if hash != t.lastHash || t.changedAt.IsZero() {
+		t.changedAt = ts
+	}
+	t.lastHash = hash
+}
+
+func (t *dataChangeTracker) age() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.changedAt.IsZero() {
+		return 0 // no data seen yet
+	}
+	return time.Since(t.changedAt).Seconds()
+}
+
+// registerDataAgeGauge exposes the age of the data seen by a watcher, replacing the gauge of an earlier one (only
+// the tests create more than one)
+func registerDataAgeGauge(tracker *dataChangeTracker) {
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "foxpost_data_age_seconds",
+		Help: "Seconds since the upstream APM data last changed (based on Last-Modified or payload hash).",
+	}, tracker.age)
+	prometheus.Unregister(gauge)
+	_ = prometheus.Register(gauge) // can only fail if another watcher registered in between, which then reports
+}
+
+var (
+	runsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "foxpost_runs_total",
+		Help: "Number of collection runs since startup by result.",
+	}, []string{"result"})
+	runErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "foxpost_run_errors_total",
+		Help: "Number of failed collection runs since startup by the kind of error.",
+	}, []string{"kind"})
+	runTimeoutsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "foxpost_run_timeouts_total",
+		Help: "Number of collection runs since startup that failed by exceeding INVOCATION_TIMEOUT.",
+	})
+	lastRunPoints = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "foxpost_last_run_points",
+		Help: "Number of points written by the last run.",
+	})
+	lastRunBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "foxpost_last_run_bytes",
+		Help: "Bytes of line protocol written by the last run.",
+	})
+	pointsWrittenTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "foxpost_points_written_total",
+		Help: "Number of points written since startup.",
+	})
+	bytesWrittenTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "foxpost_bytes_written_total",
+		Help: "Bytes of line protocol written since startup.",
+	})
+)
+
+var writeErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "foxpost_write_errors_total",
+	Help: "Number of failed writes since startup by backend and the kind of error (write, unreachable or timeout).",
+}, []string{"backend", "kind"})
+
+var writeRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "foxpost_write_retries_total",
+	Help: "Number of writes retried after a transient failure since startup by backend.",
+}, []string{"backend"})
+
+var (
+	decodeDurationGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "foxpost_decode_duration_seconds",
+		Help: "Seconds it took to read and decode the APM data during the last successful fetch.",
+	})
+	decodedEntriesGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "foxpost_decoded_entries",
+		Help: "Number of APMs decoded during the last successful fetch.",
+	})
+)
+
+var cdnResponsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "foxpost_cdn_responses_total",
+	Help: "Number of responses received from the Foxpost API by HTTP status code, including the retried ones.",
+}, []string{"code"})
+
+// responseCounter counts the responses of the Foxpost API by status code, including the ones that were retried
+type responseCounter map[int]int
+
+func (c responseCounter) total() int {
+	total := 0
+	for _, n := range c {
+		total += n
+	}
+	return total
+}
+
+func (c responseCounter) String() string {
+	codes := make([]int, 0, len(c))
+	for code := range c {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+
+	parts := make([]string, len(codes))
+	for i, code := range codes {
+		parts[i] = fmt.Sprintf("%d=%d", code, c[code])
+	}
+	return strings.Join(parts, " ")
+}
+
+var congestionIndexGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "foxpost_congestion_index",
+	Help: "Average load weight over all APMs, 0-100 with the default weights. Only set when EMIT_CONGESTION_INDEX is enabled.",
+})
+
+// runStats keeps track of the runs since startup, used for the periodic summary log
+type runStats struct {
+	mu         sync.Mutex
+	startedAt  time.Time
+	runs       uint64
+	failures   uint64
+	lastPoints int
+	responses  responseCounter // of the Foxpost API
+}
+
+func newRunStats() *runStats {
+	return &runStats{startedAt: time.Now()}
+}
+
+func (s *runStats) record(res runResult, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.runs++
+	s.lastPoints = res.pointsWritten
+	lastRunPoints.Set(float64(res.pointsWritten))
+	lastRunBytes.Set(float64(res.bytesWritten))
+	if failed {
+		s.failures++
+		runsTotal.WithLabelValues("failure").Inc()
+	} else {
+		runsTotal.WithLabelValues("success").Inc()
+	}
+}
+
+func (s *runStats) recordResponse(statusCode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.responses == nil {
+		s.responses = responseCounter{}
+	}
+	s.responses[statusCode]++
+}
+
+func (s *runStats) runCount() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.runs
+}
+
+func (s *runStats) summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summary := fmt.Sprintf("uptime %s, %d runs, %d failures, last %d points",
+		time.Since(s.startedAt).Round(time.Second), s.runs, s.failures, s.lastPoints)
+	if len(s.responses) > 0 {
+		summary += ", responses " + s.responses.String()
+	}
+	return summary
+}
+
+var topLoadedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "foxpost_top_loaded",
+	Help: "Load of the TOP_N_LOADED most loaded watched places after the last run, by rank (1 is the most loaded).",
+}, []string{"rank", "place_id", "name"})
+
+// reportTopLoaded logs the most loaded places and replaces the previous ones in the metrics
+func reportTopLoaded(top []loadedPlace) {
+	topLoadedGauge.Reset()
+	parts := make([]string, len(top))
+	for i, place := range top {
+		placeID := strconv.FormatUint(place.placeID, 10)
+		topLoadedGauge.WithLabelValues(strconv.Itoa(i+1), placeID, place.name).Set(float64(place.load))
+		parts[i] = fmt.Sprintf("%s (%s) %d", placeID, place.name, place.load)
+	}
+	log.Printf("Top %d loaded places: %s", len(top), strings.Join(parts, ", "))
+}
+
+// logRuntimeStats logs the goroutine count and the heap usage every interval, to spot leaks of the long-running daemon.
+// The same (and more) is exposed by the standard Go metrics.
+func logRuntimeStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		log.Printf("Runtime stats: %d goroutines, %.1f MiB heap allocated (%.1f MiB from the OS), %d GCs",
+			runtime.NumGoroutine(), float64(mem.HeapAlloc)/(1<<20), float64(mem.Sys)/(1<<20), mem.NumGC)
+	}
+}
@@ -0,0 +1,53 @@
+package watcher
+
+import (
+	"log"
+	"math"
+)
+
+// maxNeighborPlaces is the number of watched places above which the nearest neighbors are not computed, as it takes
+// quadratic time
+const maxNeighborPlaces = 5000
+
+// earthRadiusKm is the mean radius of the Earth
+const earthRadiusKm = 6371.0
+
+// distanceKm is the great-circle distance between two coordinates (haversine formula)
+func distanceKm(lat1, lng1, lat2, lng2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLng := toRad(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(min(a, 1)))
+}
+
+// nearestNeighbors returns the distance of each watched place in the APM data to the nearest other one, by place id.
+// A place alone in the watch set has none. Returns nil (with a warning) above maxNeighborPlaces.
+func (w *Watcher) nearestNeighbors(apmsData []APMData) map[uint64]float64 {
+	var places []APMData
+	seen := map[uint64]bool{}
+	for _, apmData := range apmsData {
+		if w.watches(apmData) && !seen[apmData.PlaceID] {
+			seen[apmData.PlaceID] = true
+			places = append(places, apmData)
+		}
+	}
+	if len(places) > maxNeighborPlaces {
+		log.Printf("WARNING: %d places are watched, not computing the nearest neighbors above %d", len(places), maxNeighborPlaces)
+		return nil
+	}
+
+	nearest := make(map[uint64]float64, len(places))
+	for i, a := range places {
+		for _, b := range places[i+1:] {
+			d := distanceKm(a.GeoLat, a.GeoLng, b.GeoLat, b.GeoLng)
+			if prev, ok := nearest[a.PlaceID]; !ok || d < prev {
+				nearest[a.PlaceID] = d
+			}
+			if prev, ok := nearest[b.PlaceID]; !ok || d < prev {
+				nearest[b.PlaceID] = d
+			}
+		}
+	}
+	return nearest
+}
@@ -0,0 +1,241 @@
+package watcher
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// measurementSchema describes the tags and fields of a measurement written by the watcher
+type measurementSchema struct {
+	name   string
+	tags   []string
+	fields map[string]string // field key to its line protocol type
+	note   string
+}
+
+// influxType names the line protocol type of the field value
+func influxType(value interface{}) string {
+	switch value.(type) {
+	case uint8, uint64:
+		return "uinteger"
+	case int, int64:
+		return "integer"
+	case float64:
+		return "float"
+	case bool:
+		return "boolean"
+	default:
+		return "string"
+	}
+}
+
+func fieldTypes(fields map[string]interface{}) map[string]string {
+	types := make(map[string]string, len(fields))
+	for key, value := range fields {
+		types[key] = influxType(value)
+	}
+	return types
+}
+
+// schema lists the measurements the current config writes, built the same way as the points themselves
+func (w *Watcher) schema() []measurementSchema {
+	// sample values of the right types, passed through the same selection and renaming as the real ones
+	fields := map[string]interface{}{
+		"load":   uint8(0),
+		"geoLat": 0.0,
+		"geoLng": 0.0,
+	}
+	if w.EmptyLoadMode == "field" {
+		fields["load_missing"] = 1
+	}
+	if w.LoadEncoding != "percent" {
+		fields["load_code"] = 0
+		fields["load_label"] = ""
+	}
+	if w.LoadEncoding == "enum" {
+		delete(fields, "load")
+	}
+	if w.sourceAs() == "field" {
+		fields["source"] = ""
+	}
+	if w.NormalizeTags && w.KeepOriginalTags {
+		fields["name_original"] = ""
+		fields["operator_id_original"] = ""
+	}
+	if w.EmitMissing {
+		fields["present"] = 1
+	}
+	if w.EmitDataLag {
+		fields["data_lag_seconds"] = 0.0
+	}
+	if w.EmitBandFlags {
+		fields["is_normal"] = false
+		fields["is_medium"] = false
+		fields["is_overloaded"] = false
+	}
+	if w.EmitLoadDelta {
+		fields["load_delta"] = 0
+	}
+	if w.EmitNearestNeighbor {
+		fields["nearest_neighbor_km"] = 0.0
+	}
+	if w.LoadSmoothingAlpha > 0 {
+		fields["load_smoothed"] = 0.0
+	}
+	fields = renameFields(selectFields(fields, w.WriteFields), w.FieldNameMap)
+	places := measurementSchema{
+		name:   w.InfluxMeasurement,
+		tags:   []string{"place_id", "operator_id", "name"},
+		fields: fieldTypes(fields),
+	}
+	if w.sourceAs() == "tag" {
+		places.tags = append(places.tags, "source")
+	}
+	if w.TransitionOnly {
+		places.tags = append(places.tags, "transition")
+	}
+	if w.DuplicatePlacePolicy == "tag" {
+		places.tags = append(places.tags, "duplicate") // only on the repeated occurrences of a place
+	}
+	for _, field := range w.EnrichFields {
+		places.fields["detail_"+field] = "as in the details" // the type comes from the detail endpoint
+	}
+	for _, key := range w.ExtraFields {
+		places.fields["extra_"+key] = "as in the APM data"
+	}
+
+	loadName := "load"
+	if renamed, ok := w.FieldNameMap[loadName]; ok {
+		loadName = renamed
+	}
+	states := make([]string, 0, len(loadMap))
+	for state := range loadMap {
+		states = append(states, state)
+	}
+	slices.SortFunc(states, func(a, b string) int {
+		if loadMap[a] != loadMap[b] {
+			return cmp.Compare(loadMap[a], loadMap[b])
+		}
+		return cmp.Compare(a, b)
+	})
+	mapping := make([]string, len(states))
+	for i, state := range states {
+		value := loadMap[state]
+		if state == "" && w.EmptyLoadMode == "value" {
+			value = w.EmptyLoadValue
+		}
+		mapping[i] = fmt.Sprintf("%q=%d", state, value)
+	}
+	if _, ok := places.fields[loadName]; ok {
+		places.note = fmt.Sprintf("%s: %s", loadName, strings.Join(mapping, ", "))
+	}
+	if _, ok := places.fields["load_code"]; ok {
+		codes := make([]string, len(states))
+		for i, state := range states {
+			codes[i] = fmt.Sprintf("%q=%d", state, loadCodes[state])
+		}
+		if places.note != "" {
+			places.note += "\n  "
+		}
+		places.note += "load_code: " + strings.Join(codes, ", ")
+	}
+	switch w.EmptyLoadMode {
+	case "skip":
+		places.note += ` (places with "" are not written)`
+	case "field":
+		places.note += ` (places with "" are written with load_missing=1 instead)`
+	}
+	if w.FieldLayout == "narrow" {
+		// a point per field, the note on them still applies
+		metrics := make([]string, 0, len(places.fields))
+		for name := range places.fields {
+			metrics = append(metrics, name)
+		}
+		slices.Sort(metrics)
+		places.tags = append(places.tags, "metric")
+		places.fields = map[string]string{"value": "float", "value_string": "string"}
+		places.note = strings.TrimPrefix(places.note+"\n  metric: "+strings.Join(metrics, ", "), "\n  ")
+	}
+	result := []measurementSchema{places}
+
+	if w.EmitLoadMapMeta {
+		meta := make(map[string]string, len(loadMap))
+		for state := range loadMap {
+			if state == "" {
+				state = "empty"
+			}
+			meta[state] = "uinteger"
+		}
+		result = append(result, measurementSchema{name: w.InfluxMeasurement + "_meta", fields: meta})
+	}
+	if w.CongestionWeights != nil {
+		result = append(result, measurementSchema{
+			name:   w.InfluxMeasurement + "_congestion",
+			fields: map[string]string{"index": "float", "apms": "integer"},
+		})
+	}
+	if w.EmitRunEvents || w.EmitHeartbeat {
+		runs := measurementSchema{name: w.InfluxMeasurement + "_runs", fields: map[string]string{"matched": "integer"}}
+		if w.EmitRunEvents {
+			runs.fields["points"] = "integer"
+			runs.fields["bytes"] = "integer"
+			runs.fields["decoded"] = "integer"
+			runs.fields["decode_seconds"] = "float"
+			for _, name := range w.LogResponseHeaders {
+				runs.fields["header_"+strings.ReplaceAll(strings.ToLower(name), "-", "_")] = "string"
+			}
+		}
+		result = append(result, runs)
+	}
+	if w.TrackMetadataChanges {
+		result = append(result, measurementSchema{
+			name: w.InfluxMeasurement + "_metadata",
+			tags: []string{"place_id"},
+			fields: map[string]string{
+				"name": "string", "operator_id": "string", "previous_name": "string", "previous_operator_id": "string",
+			},
+		})
+	}
+	for i := range result {
+		if w.VersionTag {
+			result[i].tags = append(result[i].tags, "collector_version")
+		}
+		if w.InstanceTag {
+			result[i].tags = append(result[i].tags, "instance")
+		}
+		if w.VersionField {
+			result[i].fields["collector_version"] = "string"
+		}
+		if w.EmitPollSeq {
+			result[i].fields["poll_seq"] = "integer"
+		}
+	}
+	return result
+}
+
+// Schema describes the measurements, their tag keys and field keys (with their types) the current config writes.
+// Nothing is fetched or written.
+func (w *Watcher) Schema() string {
+	var sb strings.Builder
+	for _, m := range w.schema() {
+		fmt.Fprintf(&sb, "measurement %s\n", m.name)
+		if len(m.tags) > 0 {
+			fmt.Fprintf(&sb, "  tags: %s\n", strings.Join(m.tags, ", "))
+		}
+		keys := make([]string, 0, len(m.fields))
+		for key := range m.fields {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		sb.WriteString("  fields:\n")
+		for _, key := range keys {
+			fmt.Fprintf(&sb, "    %s %s\n", key, m.fields[key])
+		}
+		if m.note != "" {
+			fmt.Fprintf(&sb, "  %s\n", m.note)
+		}
+	}
+	return sb.String()
+}
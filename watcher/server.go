@@ -0,0 +1,247 @@
+package watcher
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// placeStatus is the latest known state of a watched place, served by the read API
+type placeStatus struct {
+	PlaceID    uint64    `json:"place_id"`
+	OperatorID string    `json:"operator_id"`
+	Name       string    `json:"name"`
+	GeoLat     float64   `json:"geolat"`
+	GeoLng     float64   `json:"geolng"`
+	Load       string    `json:"load"`
+	LoadValue  uint8     `json:"load_value"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// placeStatusStore holds the latest status of each place written by run
+// Subscribers are notified when the load of a place changes (or a place first appears)
+type placeStatusStore struct {
+	mu          sync.RWMutex
+	places      map[uint64]placeStatus
+	subscribers map[chan placeStatus]struct{}
+}
+
+func newPlaceStatusStore() *placeStatusStore {
+	return &placeStatusStore{
+		places:      map[uint64]placeStatus{},
+		subscribers: map[chan placeStatus]struct{}{},
+	}
+}
+
+func (s *placeStatusStore) set(status placeStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, known := s.places[status.PlaceID]
+	s.places[status.PlaceID] = status
+
+	if known && prev.Load == status.Load {
+		return
+	}
+	for ch := range s.subscribers {
+		select {
+		case ch <- status:
+		default:
+			// slow subscriber, it will miss this event rather than blocking the collection
+		}
+	}
+}
+
+// subscribe returns the current statuses along with a channel of the subsequent load changes
+func (s *placeStatusStore) subscribe() ([]placeStatus, chan placeStatus) {
+	ch := make(chan placeStatus, 16)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers[ch] = struct{}{}
+	return s.sorted(), ch
+}
+
+func (s *placeStatusStore) unsubscribe(ch chan placeStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers, ch)
+}
+
+func (s *placeStatusStore) get(placeID uint64) (placeStatus, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	status, ok := s.places[placeID]
+	return status, ok
+}
+
+// list returns the stored statuses ordered by place id
+func (s *placeStatusStore) list() []placeStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sorted()
+}
+
+// sorted must be called with the lock held
+func (s *placeStatusStore) sorted() []placeStatus {
+	statuses := make([]placeStatus, 0, len(s.places))
+	for _, status := range s.places {
+		statuses = append(statuses, status)
+	}
+	slices.SortFunc(statuses, func(a, b placeStatus) int {
+		return cmp.Compare(a.PlaceID, b.PlaceID)
+	})
+	return statuses
+}
+
+func apmsHandler(store *placeStatusStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var statuses []placeStatus
+
+		if placeIDStr := r.URL.Query().Get("place_id"); placeIDStr != "" {
+			placeID, err := strconv.ParseUint(placeIDStr, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid place_id", http.StatusBadRequest)
+				return
+			}
+			statuses = []placeStatus{}
+			if status, ok := store.get(placeID); ok {
+				statuses = append(statuses, status)
+			}
+		} else {
+			statuses = store.list()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(statuses)
+		if err != nil {
+			log.Println("Failed to encode /apms response: ", err)
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	if err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// streamHandler pushes load changes as server-sent events, starting with a snapshot of the current state
+func streamHandler(store *placeStatusStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		snapshot, ch := store.subscribe()
+		defer store.unsubscribe(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		err := writeSSE(w, "snapshot", snapshot)
+		for err == nil {
+			select {
+			case <-r.Context().Done():
+				return // client disconnected
+			case status := <-ch:
+				err = writeSSE(w, "load_change", status)
+			}
+		}
+		log.Println("Stream client dropped: ", err)
+	}
+}
+
+// basicAuth protects the handler with HTTP basic auth
+func basicAuth(user, pass string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="foxpost-watcher"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Handler serves the metrics and the read API
+func (w *Watcher) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/apms", apmsHandler(w.latest))
+	mux.Handle("/stream", streamHandler(w.latest))
+	mux.Handle("/config", configHandler(w))
+	if w.RunHistorySize > 0 {
+		mux.Handle("/runs", runsHandler(w.history))
+	}
+	if w.HTTPTrigger {
+		mux.Handle("/trigger", triggerHandler(w))
+	}
+
+	var handler http.Handler = mux
+	if w.HTTPAuthUser != "" {
+		handler = basicAuth(w.HTTPAuthUser, w.HTTPAuthPass, handler)
+	}
+	return handler
+}
+
+// Listen binds HTTPListen, so a failure can be told before serving it with ServeListener
+func (w *Watcher) Listen() (net.Listener, error) {
+	return net.Listen("tcp", w.HTTPListen)
+}
+
+// ServeListener runs the HTTP server on ln, serving the Handler. Failures are only logged.
+func (w *Watcher) ServeListener(ln net.Listener) {
+	srv := &http.Server{
+		Handler:           w.Handler(),
+		ReadHeaderTimeout: 10 * time.Second, // gosec
+	}
+
+	var err error
+	if w.HTTPTLSCert != nil {
+		srv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{*w.HTTPTLSCert},
+			MinVersion:   tls.VersionTLS12, // just to make gosec happy
+		}
+		log.Println("Starting HTTPS server on", ln.Addr())
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		log.Println("Starting HTTP server on", ln.Addr())
+		err = srv.Serve(ln)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println("HTTP server failed: ", err)
+	}
+}
+
+// Serve runs the HTTP server on HTTPListen, serving the Handler. Failures are only logged.
+func (w *Watcher) Serve() {
+	ln, err := w.Listen()
+	if err != nil {
+		log.Println("HTTP server failed: ", err)
+		return
+	}
+	w.ServeListener(ln)
+}
@@ -0,0 +1,70 @@
+package watcher
+
+import (
+	"cmp"
+	"os"
+	"slices"
+)
+
+// LoadChange is a place whose load differs between two snapshots
+type LoadChange struct {
+	PlaceID uint64 `json:"place_id"`
+	Name    string `json:"name"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// SnapshotDiff holds the differences between two snapshots of the APM data, each list is ordered by place id
+type SnapshotDiff struct {
+	Changed     []LoadChange `json:"changed"`
+	Appeared    []APMData    `json:"appeared"`
+	Disappeared []APMData    `json:"disappeared"`
+}
+
+// ReadSnapshot decodes APM data saved to a file, format and wrappedKey are the same as PayloadFormat and
+// PayloadWrappedKey
+func ReadSnapshot(path string, format string, wrappedKey string) ([]APMData, error) {
+	f, err := os.Open(path) // #nosec G304 -- path comes from the operator
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeAPMs(f, format, wrappedKey, &apmDecoder{})
+}
+
+// DiffSnapshots tells which places changed load, appeared or disappeared from oldAPMs to newAPMs
+func DiffSnapshots(oldAPMs, newAPMs []APMData) SnapshotDiff {
+	oldByID := make(map[uint64]APMData, len(oldAPMs))
+	for _, apmData := range oldAPMs {
+		oldByID[apmData.PlaceID] = apmData
+	}
+	newByID := make(map[uint64]APMData, len(newAPMs))
+	for _, apmData := range newAPMs {
+		newByID[apmData.PlaceID] = apmData
+	}
+
+	diff := SnapshotDiff{
+		Changed:     make([]LoadChange, 0),
+		Appeared:    make([]APMData, 0),
+		Disappeared: make([]APMData, 0),
+	}
+	for placeID, newAPM := range newByID {
+		oldAPM, ok := oldByID[placeID]
+		if !ok {
+			diff.Appeared = append(diff.Appeared, newAPM)
+		} else if oldAPM.Load != newAPM.Load {
+			diff.Changed = append(diff.Changed, LoadChange{PlaceID: placeID, Name: newAPM.Name, From: oldAPM.Load, To: newAPM.Load})
+		}
+	}
+	for placeID, oldAPM := range oldByID {
+		if _, ok := newByID[placeID]; !ok {
+			diff.Disappeared = append(diff.Disappeared, oldAPM)
+		}
+	}
+
+	slices.SortFunc(diff.Changed, func(a, b LoadChange) int { return cmp.Compare(a.PlaceID, b.PlaceID) })
+	byPlaceID := func(a, b APMData) int { return cmp.Compare(a.PlaceID, b.PlaceID) }
+	slices.SortFunc(diff.Appeared, byPlaceID)
+	slices.SortFunc(diff.Disappeared, byPlaceID)
+	return diff
+}
@@ -0,0 +1,120 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// telegramSendTimeout bounds the sending of an alert, the retry included
+const telegramSendTimeout = 45 * time.Second
+
+// maxTelegramRetryAfter is the longest wait asked by a rate limited Telegram API that is waited out before resending
+const maxTelegramRetryAfter = 30 * time.Second
+
+// telegramNotifier sends the overload alerts as messages of a Telegram bot
+type telegramNotifier struct {
+	apiURL string // the bot api url including the token, e.g. https://api.telegram.org/bot<token>
+	chatID string
+	client *http.Client
+	sends  sync.WaitGroup // the alerts being sent by notifyAsync
+}
+
+func newTelegramNotifier(apiURL, token, chatID string) *telegramNotifier {
+	return &telegramNotifier{
+		apiURL: strings.TrimSuffix(apiURL, "/") + "/bot" + token,
+		chatID: chatID,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// telegramResponse is the part of the response of the bot api we care about
+type telegramResponse struct {
+	OK          bool   `json:"ok"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"` // seconds to wait when rate limited
+	} `json:"parameters"`
+}
+
+// send posts the message to the chat, returns how long to wait before retrying if rate limited
+func (n *telegramNotifier) send(ctx context.Context, text string) (time.Duration, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"chat_id":                  n.chatID,
+		"text":                     text,
+		"disable_web_page_preview": true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.apiURL+"/sendMessage", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, errors.New(strings.ReplaceAll(err.Error(), n.apiURL, "[bot api]")) // the url holds the token
+	}
+	defer resp.Body.Close()
+
+	var result telegramResponse
+	_ = json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return time.Duration(result.Parameters.RetryAfter) * time.Second, fmt.Errorf("rate limited: %s", result.Description)
+	}
+	if !result.OK {
+		return 0, fmt.Errorf("status %d: %s", resp.StatusCode, result.Description)
+	}
+	return 0, nil
+}
+
+// notify sends the message, once more if rate limited for a short while, within telegramSendTimeout (not bound to
+// the run). Failures are only logged.
+func (n *telegramNotifier) notify(text string) {
+	ctx, cancel := context.WithTimeout(context.Background(), telegramSendTimeout)
+	defer cancel()
+
+	retryAfter, err := n.send(ctx, text)
+	if err != nil && retryAfter > 0 && retryAfter <= maxTelegramRetryAfter {
+		log.Printf("Telegram rate limited the alert, resending in %s", retryAfter)
+		select {
+		case <-time.After(retryAfter):
+			_, err = n.send(ctx, text)
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		log.Println("Could not send the alert to Telegram: ", err)
+	}
+}
+
+// mapsLink points to the place on Google Maps
+func mapsLink(lat, lng float64) string {
+	return fmt.Sprintf("https://www.google.com/maps/search/?api=1&query=%f,%f", lat, lng)
+}
+
+// notifyAsync sends the message in the background, like notify
+func (n *telegramNotifier) notifyAsync(text string) {
+	n.sends.Add(1)
+	go func() {
+		defer n.sends.Done()
+		n.notify(text)
+	}()
+}
+
+// wait waits for the alerts being sent, at most telegramSendTimeout. Does nothing on a nil notifier.
+func (n *telegramNotifier) wait() {
+	if n != nil {
+		n.sends.Wait()
+	}
+}
@@ -0,0 +1,82 @@
+package watcher
+
+import (
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTelegram is a bot api counting the sent messages, answering once release is closed
+type testTelegram struct {
+	mu      sync.Mutex
+	sent    int
+	release chan struct{}
+}
+
+func newTestTelegram(t *testing.T) (*testTelegram, string) {
+	t.Helper()
+	tg := &testTelegram{release: make(chan struct{})}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		<-tg.release
+		tg.mu.Lock()
+		tg.sent++
+		tg.mu.Unlock()
+		_, _ = rw.Write([]byte(`{"ok": true}`))
+	}))
+	t.Cleanup(srv.Close)
+	return tg, srv.URL
+}
+
+func (tg *testTelegram) sentCount() int {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	return tg.sent
+}
+
+func TestOverloadAlertTelegram(t *testing.T) {
+	tests := []struct {
+		name        string
+		writeStatus int
+		wantSent    int
+	}{
+		{name: "written", writeStatus: http.StatusNoContent, wantSent: 1},
+		{name: "write failed", writeStatus: http.StatusBadRequest, wantSent: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			influx := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				rw.WriteHeader(tt.writeStatus)
+			}))
+			defer influx.Close()
+			client := influxdb2.NewClientWithOptions(influx.URL, "token", influxdb2.DefaultOptions().SetMaxRetries(0))
+			defer client.Close()
+
+			tg, tgURL := newTestTelegram(t)
+			w := newTestWatcher(t, testAPMs, Config{
+				PlaceIDs:               []uint64{1001, 1002},
+				InfluxClient:           client,
+				InfluxOrg:              "org",
+				InfluxBucket:           "bucket",
+				OverloadRatioThreshold: 0.5,
+				TelegramBotToken:       "token",
+				TelegramChatID:         "chat",
+				TelegramAPIURL:         tgURL,
+			})
+
+			start := time.Now()
+			_, _ = invoke(w)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("the run took %s, waiting for Telegram", elapsed)
+			}
+			close(tg.release)
+			w.telegram.wait()
+
+			if sent := tg.sentCount(); sent != tt.wantSent {
+				t.Errorf("%d alerts sent, want %d", sent, tt.wantSent)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package watcher
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// triggerLimiter lets a triggered collection run at most once every interval
+type triggerLimiter struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// allow reports whether a collection can be triggered now, or how long to wait if not
+func (l *triggerLimiter) allow(interval time.Duration) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if wait := interval - time.Since(l.last); !l.last.IsZero() && wait > 0 {
+		return false, wait
+	}
+	l.last = time.Now()
+	return true, 0
+}
+
+// triggerResult summarizes a triggered collection
+type triggerResult struct {
+	Success         bool    `json:"success"`
+	Error           string  `json:"error,omitempty"`
+	Matched         int     `json:"matched"`
+	PointsWritten   int     `json:"points_written"`
+	BytesWritten    int     `json:"bytes_written"`
+	APMsTotal       int     `json:"apms_total"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// triggerHandler runs a collection right away (after the running one, if any) and responds with its summary.
+// The scheduled collections are not affected.
+func triggerHandler(watcher *Watcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ok, wait := watcher.trigger.allow(watcher.HTTPTriggerMinInterval)
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "too many triggers", http.StatusTooManyRequests)
+			return
+		}
+
+		log.Println("Collection triggered by", r.RemoteAddr)
+		start := time.Now()
+		res, err := invokeTriggered(watcher)
+		result := triggerResult{
+			Success:         err == nil,
+			Matched:         res.matched,
+			PointsWritten:   res.pointsWritten,
+			BytesWritten:    res.bytesWritten,
+			APMsTotal:       res.apmsTotal,
+			DurationSeconds: time.Since(start).Seconds(),
+		}
+		status := http.StatusOK
+		if err != nil {
+			result.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		err = json.NewEncoder(w).Encode(result)
+		if err != nil {
+			log.Println("Failed to encode /trigger response: ", err)
+		}
+	}
+}
+
+// invokeTriggered runs a triggered collection with the panic policy of the daemon. net/http recovers the panics of
+// the handlers, so with CrashOnPanic the collection runs in a goroutine of its own, where a panic crashes the daemon.
+func invokeTriggered(w *Watcher) (runResult, error) {
+	if !w.CrashOnPanic {
+		return safeInvoke(w)
+	}
+	type outcome struct {
+		res runResult
+		err error
+	}
+	done := make(chan outcome)
+	go func() {
+		res, err := safeInvoke(w)
+		done <- outcome{res: res, err: err}
+	}()
+	o := <-done
+	return o.res, o.err
+}
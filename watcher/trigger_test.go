@@ -0,0 +1,68 @@
+package watcher
+
+import (
+	"encoding/json"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// panickingInflux is an InfluxDB client panicking once written to
+type panickingInflux struct {
+	influxdb2.Client
+}
+
+func (panickingInflux) WriteAPIBlocking(string, string) api.WriteAPIBlocking {
+	panic("test panic")
+}
+
+// triggerPanickingRun posts to the trigger handler of a watcher whose run panics
+func triggerPanickingRun(t *testing.T, crashOnPanic bool) *http.Response {
+	t.Helper()
+	w := newTestWatcher(t, testAPMs, Config{
+		InfluxClient: panickingInflux{},
+		InfluxOrg:    "org",
+		InfluxBucket: "bucket",
+		CrashOnPanic: crashOnPanic,
+	})
+	srv := httptest.NewServer(triggerHandler(w))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Post(srv.URL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func TestTriggerPanicRecovered(t *testing.T) {
+	resp := triggerPanickingRun(t, false)
+	var result triggerResult
+	err := json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusInternalServerError || result.Success || !strings.Contains(result.Error, "test panic") {
+		t.Errorf("got %d %+v, want 500 with the panic", resp.StatusCode, result)
+	}
+}
+
+func TestTriggerPanicCrashes(t *testing.T) {
+	if os.Getenv("FW_TEST_TRIGGER_CRASH") == "1" {
+		triggerPanickingRun(t, true)
+		return // the panic should have crashed the test binary by now
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestTriggerPanicCrashes$") // #nosec G204 -- the test binary itself
+	cmd.Env = append(os.Environ(), "FW_TEST_TRIGGER_CRASH=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "panic: test panic") {
+		t.Errorf("the triggered run did not crash with the panic (%v):\n%s", err, out)
+	}
+}
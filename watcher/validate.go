@@ -0,0 +1,44 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// Check fetches the APM data once and checks that the configured places are present in it. Nothing is written.
+// Returns a PASS/FAIL line for each step, and whether every step passed.
+func (w *Watcher) Check(ctx context.Context) (results []string, passed bool) {
+	fetch, err := fetchAPMs(ctx, w)
+	if err != nil {
+		return append(results, fmt.Sprintf("FAIL fetch: %s", err)), false
+	}
+	apmsData := fetch.apms
+	results = append(results, fmt.Sprintf("PASS fetch (%d APMs from %s)", len(apmsData), fetch.source))
+
+	found := make([]uint64, 0, len(w.PlaceIDs))
+	for _, apmData := range apmsData {
+		if w.watches(apmData) {
+			found = append(found, apmData.PlaceID)
+		}
+	}
+
+	missing := make([]uint64, 0)
+	for _, placeID := range w.PlaceIDs {
+		if !slices.Contains(found, placeID) {
+			missing = append(missing, placeID)
+		}
+	}
+
+	if len(found) == 0 {
+		return append(results, fmt.Sprintf("FAIL places: none of the configured places found (missing: %v)", missing)), false
+	}
+	if len(w.PlaceIDs) == 0 {
+		results = append(results, fmt.Sprintf("PASS places: %d found in the watched cities and zips", len(found)))
+	} else if len(missing) > 0 {
+		results = append(results, fmt.Sprintf("PASS places: %d of %d found (missing: %v)", len(found), len(w.PlaceIDs), missing))
+	} else {
+		results = append(results, fmt.Sprintf("PASS places: all %d found", len(found)))
+	}
+	return results, true
+}
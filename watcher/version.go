@@ -0,0 +1,33 @@
+package watcher
+
+import "runtime/debug"
+
+// buildVersion tells the version of the binary from its build info: the module version, or the vcs revision when
+// built from a checkout
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "unknown"
+	}
+	revision = revision[:min(len(revision), 12)]
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
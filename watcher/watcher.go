@@ -0,0 +1,1385 @@
+package watcher
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-retryablehttp"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api/write"
+	"log"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds everything a Watcher needs. Zero values fall back to the defaults of the CLI, where that makes sense.
+type Config struct {
+	Timeout     time.Duration // total timeout of a single run, 1m by default
+	FetchBudget time.Duration // the part of Timeout the fetch may take, all of it if zero
+	// the places to watch, they have to match every filter set: PlaceIDs, Cities (case and spacing insensitive) and Zips
+	PlaceIDs         []uint64
+	Cities           []string
+	Zips             []string
+	APMsURLs         []string // tried in order until one succeeds, the Foxpost CDN by default
+	MaxResponseBytes int64    // 64 MiB by default
+	// record the url the data was served by as a "field", a "tag" or "none", a field if empty and there are more urls
+	SourceAs          string
+	HTTPMethod        string // method of the APM data requests, GET by default
+	RequestBody       string // JSON body of the APM data requests, none if empty
+	PayloadFormat     string // "array" (default), "ndjson" or "wrapped"
+	PayloadWrappedKey string // "apms" by default
+	APMJSONFieldMap   map[string]string
+	ValidateSchema    bool // fail the decoding when an APM misses a key the watcher relies on, or has it with another type
+	// keys of the APM data not known by the watcher to write as extra_<key> fields, only primitive values are written
+	ExtraFields   []string
+	EmitRunEvents bool
+	// add the collector_version tag (which adds series on every deploy) or field to every point
+	VersionTag bool
+	// add an instance tag holding InstanceID (the hostname by default) to every point, to tell the collectors apart
+	InstanceTag            bool
+	InstanceID             string
+	VersionField           bool
+	EmitPollSeq            bool   // add the poll_seq field to every point, the number of the run since startup
+	CollectorVersion       string // from the build info by default
+	EmitHeartbeat          bool   // write a point with only the matched count to the run events, even without EmitRunEvents
+	LogResponseHeaders     []string
+	Output                 string           // where to write the points: "influxdb" (default) or "udp" (to UDPAddr)
+	UDPAddr                string           // host:port to send the line protocol datagrams to
+	InfluxClient           influxdb2.Client // only needed when writing to InfluxDB, or for the dry run diff. Create it with SetMaxRetries(0), see WriteRetries
+	InfluxOrg              string
+	InfluxBucket           string
+	BandBuckets            map[int]string // bucket of the places by their band of LoadBands (0 is the lowest), InfluxBucket for the others
+	InfluxMeasurement      string         // "foxpost" by default
+	InfluxPrecision        time.Duration  // time.Nanosecond by default
+	TimestampSource        string         // "fetch" (default, the time of the request) or "last-modified"
+	MaxClockSkew           time.Duration  // Last-Modified further from the local time is not used, 24h by default
+	DryRun                 bool
+	DryRunDiff             bool
+	DryRunDiffRange        time.Duration // 30 days by default
+	HTTPBackoff            retryablehttp.Backoff
+	HTTPNetwork            string // "tcp" (default), "tcp4" or "tcp6"
+	HTTPDisableKeepAlive   bool
+	HTTPIdleConnTimeout    time.Duration // the retry library's default (90s) if zero
+	HTTPLogger             *slog.Logger  // slog.Default() by default
+	PollInterval           time.Duration // 1h by default
+	MaxLifetime            time.Duration // Run returns after this long (once the running collection finished), never if zero
+	HTTPListen             string
+	HTTPTLSCert            *tls.Certificate // nil for plain HTTP
+	HTTPAuthUser           string           // empty if auth is disabled
+	HTTPAuthPass           string
+	HTTPTrigger            bool          // serve POST /trigger to run a collection right away
+	HTTPTriggerMinInterval time.Duration // time to wait between two triggered collections
+	SummaryEvery           int
+	RunHistorySize         int           // number of the last runs of the daemon to keep for /runs
+	RuntimeStatsInterval   time.Duration // log the goroutine count and heap usage this often when running as daemon, disabled if zero
+	EmitLoadDelta          bool
+	// how the fields of the places are written: "wide" (a point per place, default) or "narrow" (a point per field of
+	// each place, tagged with the metric, holding a value or a value_string field)
+	FieldLayout         string
+	LoadSmoothingAlpha  float64 // weight of the current load in the load_smoothed field, disabled if zero
+	EmitDataLag         bool
+	EmitNearestNeighbor bool // write the distance of each watched place to the nearest other one
+	SortByPlaceID       bool
+	// what to do with the repeated occurrences of a place in the APM data: write them as well (default, the last one
+	// overwrites the others), "skip" them or "tag" them with their number in the duplicate tag
+	DuplicatePlacePolicy string
+	EmitMissing          bool
+	MissingGracePolls    int // number of consecutive polls a place has to be absent for to be written as missing
+	WriteBatchSize       int // 1 by default
+	MaxWriteErrors       int // failed writes to tolerate before failing the run, the first one fails it if zero
+	// times to retry a write failing with a transient error (e.g. InfluxDB unreachable) within the run, waiting
+	// WriteRetryBackoff before the first retry, doubled for the next ones. The InfluxClient must not retry itself: its
+	// retry queue returns nil for the writes following a 429 or 503 within its retry interval, without sending them.
+	WriteRetries      int
+	WriteRetryBackoff time.Duration
+	DeadLetterFile    string // the line protocol of the points that failed to write is appended to it, if set
+	CrashOnPanic      bool
+	CongestionWeights map[string]float64 // nil if the congestion index is disabled
+	QuietStart        bool
+	EmitLoadMapMeta   bool
+	FieldNameMap      map[string]string
+	WriteFields       []string // all fields are written if empty
+	PostRunCommand    string
+	PostRunTimeout    time.Duration // 30s by default
+	PostRunFailRun    bool
+	// add EnrichFields of the detail of each place, downloaded from DetailURLTemplate (with {place_id} replaced)
+	EnrichDetails     bool
+	DetailURLTemplate string
+	EnrichFields      []string
+	EnrichConcurrency int // 4 by default
+	// how to write the places without load: "" (as normal loaded), "value" (as EmptyLoadValue), "skip" or "field"
+	// (without load, with load_missing=1 instead)
+	EmptyLoadMode  string
+	EmptyLoadValue uint8
+	// how to write the load: "percent" (the load field, 10-100, default), "enum" (the load_code field, 0-3, and the
+	// load_label field) or "both"
+	LoadEncoding string
+	// trim and collapse the whitespace of the name and operator_id tags, optionally lowercase them and keep the
+	// original values in the name_original and operator_id_original fields
+	NormalizeTags    bool
+	LowercaseTags    bool
+	KeepOriginalTags bool
+	// only write a place when its load moves to another band (split by the LoadBands thresholds) since the last point
+	BandOnly  bool
+	LoadBands []uint8 // 70 (medium loaded) and 100 (overloaded) by default
+	// only write a place when it enters or leaves the TransitionBands, tagged with the transition
+	TransitionOnly  bool
+	TransitionBands []int // the highest band by default
+	// write the is_normal, is_medium and is_overloaded boolean fields telling the band of the load (needs two LoadBands)
+	EmitBandFlags bool
+	// write a point to the <measurement>_metadata measurement when the name or operator_id of a place changes
+	TrackMetadataChanges bool
+	// log and skip the places that panic while being processed, instead of failing the whole run
+	ContinueOnPlacePanic bool
+	// alert when at least this ratio (0-1) of the watched places are overloaded, disabled if zero
+	OverloadRatioThreshold float64
+	OverloadAlertCooldown  time.Duration // repeat the alert this often while it fires, only once if zero
+	AlertStateFile         string        // the state of the alert is saved to it, so it survives restarts, kept in memory only if empty
+	// send the overload alerts to the TelegramChatID through the bot, if both are set
+	TelegramBotToken string
+	TelegramChatID   string
+	TelegramAPIURL   string // https://api.telegram.org by default
+	FailOnZeroPoints bool   // fail the run if it completed without writing a point of the places
+	TopNLoaded       int    // log (and expose as metrics) this many most loaded places after each run
+}
+
+// Watcher collects the load of the configured places, create one with New
+type Watcher struct {
+	Config
+	stats   *runStats
+	history *runHistory
+	latest  *placeStatusStore
+	cities  []string // normalized
+
+	overloadAlert overloadAlert
+	telegram      *telegramNotifier // nil if not set up
+	decoder       *apmDecoder       // the decoding options of the config
+	// makes sure every nested extra field is logged only once, not for every APM
+	warnedNestedExtras sync.Map
+	emptyLoadNotice    sync.Once         // makes sure the notice about the places without load is only logged once
+	dataChange         dataChangeTracker // when the fetched data last changed, for the data age gauge
+	deadLetterMu       sync.Mutex        // serializes the appends to and the replays of the DeadLetterFile
+	absences           absenceCounter
+	smoother           loadSmoother
+	pollSeq            atomic.Uint64 // number of runs since startup, for EmitPollSeq
+	udpConn            net.Conn      // the connection of the udp output, kept for the lifetime of the watcher
+	influxMu           sync.RWMutex  // guards InfluxClient, which may be swapped while running
+	runMu              sync.Mutex    // the scheduled and the triggered collections run one at a time
+	trigger            triggerLimiter
+	// starts the ticker of the daemon, returning its channel and its stop func, replaced by the tests to tick on demand
+	newTicker func(d time.Duration) (<-chan time.Time, func())
+}
+
+func (w *Watcher) influxClient() influxdb2.Client {
+	w.influxMu.RLock()
+	defer w.influxMu.RUnlock()
+	return w.InfluxClient
+}
+
+// SetInfluxClient swaps the InfluxDB client used by the next runs (e.g. after its certs were rotated), returns the
+// old one, so it can be closed.
+func (w *Watcher) SetInfluxClient(client influxdb2.Client) influxdb2.Client {
+	w.influxMu.Lock()
+	defer w.influxMu.Unlock()
+	old := w.InfluxClient
+	w.InfluxClient = client
+	return old
+}
+
+// New validates the config, fills in the defaults and creates a Watcher from it
+func New(cfg Config) (*Watcher, error) {
+	if len(cfg.PlaceIDs) == 0 && len(cfg.Cities) == 0 && len(cfg.Zips) == 0 {
+		return nil, errors.New("no place ids, cities or zips to watch?")
+	}
+	cities := make([]string, len(cfg.Cities))
+	for i, city := range cfg.Cities {
+		cities[i] = normalizeCity(city)
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = time.Minute
+	}
+	if cfg.FetchBudget < 0 || cfg.FetchBudget >= cfg.Timeout {
+		return nil, fmt.Errorf("the fetch budget (%s) must be shorter than the timeout (%s)", cfg.FetchBudget, cfg.Timeout)
+	}
+	if len(cfg.APMsURLs) == 0 {
+		cfg.APMsURLs = []string{"https://cdn.foxpost.hu/apms.json"}
+	}
+	if cfg.HTTPMethod == "" {
+		cfg.HTTPMethod = http.MethodGet
+	}
+	if !slices.Contains([]string{http.MethodGet, http.MethodPost}, cfg.HTTPMethod) {
+		return nil, fmt.Errorf("invalid http method: %s", cfg.HTTPMethod)
+	}
+	if cfg.RequestBody != "" && !json.Valid([]byte(cfg.RequestBody)) {
+		return nil, errors.New("the request body must be valid JSON")
+	}
+	if !slices.Contains([]string{"", "field", "tag", "none"}, cfg.SourceAs) {
+		return nil, fmt.Errorf("invalid source as: %s", cfg.SourceAs)
+	}
+	if cfg.MaxResponseBytes == 0 {
+		cfg.MaxResponseBytes = 64 << 20
+	}
+	if cfg.PayloadFormat == "" {
+		cfg.PayloadFormat = "array"
+	}
+	if !slices.Contains([]string{"array", "ndjson", "wrapped"}, cfg.PayloadFormat) {
+		return nil, fmt.Errorf("invalid payload format: %s", cfg.PayloadFormat)
+	}
+	if cfg.PayloadWrappedKey == "" {
+		cfg.PayloadWrappedKey = "apms"
+	}
+	if cfg.Output == "" {
+		cfg.Output = "influxdb"
+	}
+	if !slices.Contains([]string{"influxdb", "udp"}, cfg.Output) {
+		return nil, fmt.Errorf("invalid output: %s", cfg.Output)
+	}
+	if ((!cfg.DryRun && cfg.Output == "influxdb") || cfg.DryRunDiff) && cfg.InfluxClient == nil {
+		return nil, errors.New("an InfluxDB client is required unless in dry run")
+	}
+	var udpConn net.Conn
+	if cfg.Output == "udp" {
+		if cfg.UDPAddr == "" {
+			return nil, errors.New("the udp address is required for the udp output")
+		}
+		var err error
+		udpConn, err = net.Dial("udp", cfg.UDPAddr) // nothing is sent yet, this only resolves the address
+		if err != nil {
+			return nil, fmt.Errorf("invalid udp address: %w", err)
+		}
+	}
+	if cfg.InfluxMeasurement == "" {
+		cfg.InfluxMeasurement = "foxpost"
+	}
+	if cfg.InfluxPrecision == 0 {
+		cfg.InfluxPrecision = time.Nanosecond
+	}
+	if cfg.TimestampSource == "" {
+		cfg.TimestampSource = "fetch"
+	}
+	if !slices.Contains([]string{"fetch", "last-modified"}, cfg.TimestampSource) {
+		return nil, fmt.Errorf("invalid timestamp source: %s", cfg.TimestampSource)
+	}
+	if cfg.MaxClockSkew == 0 {
+		cfg.MaxClockSkew = 24 * time.Hour
+	}
+	if cfg.DryRunDiffRange == 0 {
+		cfg.DryRunDiffRange = 30 * 24 * time.Hour
+	}
+	if cfg.HTTPNetwork == "" {
+		cfg.HTTPNetwork = "tcp"
+	}
+	if !slices.Contains([]string{"tcp", "tcp4", "tcp6"}, cfg.HTTPNetwork) {
+		return nil, fmt.Errorf("invalid network: %s", cfg.HTTPNetwork)
+	}
+	if cfg.HTTPLogger == nil {
+		cfg.HTTPLogger = slog.Default()
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = time.Hour
+	}
+	if cfg.HTTPAuthUser != "" && cfg.HTTPAuthPass == "" {
+		return nil, errors.New("auth password is required when the auth user is set")
+	}
+	if cfg.HTTPTrigger && cfg.HTTPAuthUser == "" {
+		log.Println("WARNING: the trigger endpoint is not protected by auth, anyone reaching it can run collections")
+	}
+	cfg.WriteBatchSize = max(cfg.WriteBatchSize, 1)
+	err := validateFieldNameMap(cfg.FieldNameMap)
+	if err != nil {
+		return nil, fmt.Errorf("invalid field name map: %w", err)
+	}
+	if cfg.LoadEncoding == "" {
+		cfg.LoadEncoding = "percent"
+	}
+	if !slices.Contains([]string{"percent", "enum", "both"}, cfg.LoadEncoding) {
+		return nil, fmt.Errorf("invalid load encoding: %s", cfg.LoadEncoding)
+	}
+	if cfg.DryRunDiff && cfg.LoadEncoding == "enum" {
+		return nil, errors.New("the dry run diff compares the percent load, it does not work with the enum load encoding")
+	}
+	if len(cfg.WriteFields) > 0 {
+		err = validateWriteFields(cfg.WriteFields, cfg.EmitMissing, cfg.LoadEncoding)
+		if err != nil {
+			return nil, fmt.Errorf("invalid write fields: %w", err)
+		}
+	}
+	if cfg.EnrichDetails {
+		if !strings.Contains(cfg.DetailURLTemplate, "{place_id}") {
+			return nil, errors.New("the detail url template must contain {place_id}")
+		}
+		if len(cfg.EnrichFields) == 0 {
+			return nil, errors.New("no enrich fields selected")
+		}
+		if cfg.EnrichConcurrency <= 0 {
+			cfg.EnrichConcurrency = 4
+		}
+		if len(cfg.Cities) > 0 || len(cfg.Zips) > 0 {
+			log.Println("WARNING: fetching the details of every place in the watched cities or zips on every run, this is meant for small watch lists")
+		} else if len(cfg.PlaceIDs) > maxEnrichedPlaces {
+			log.Printf("WARNING: fetching the details of %d places on every run, this is meant for small watch lists", len(cfg.PlaceIDs))
+		}
+	}
+	if !slices.Contains([]string{"", "value", "skip", "field"}, cfg.EmptyLoadMode) {
+		return nil, fmt.Errorf("invalid empty load mode: %s", cfg.EmptyLoadMode)
+	}
+	if (cfg.BandOnly || cfg.TransitionOnly || cfg.EmitBandFlags || len(cfg.BandBuckets) > 0) && len(cfg.LoadBands) == 0 {
+		cfg.LoadBands = []uint8{loadMap["medium loaded"], loadMap["overloaded"]}
+	}
+	if cfg.FailOnZeroPoints && (cfg.BandOnly || cfg.TransitionOnly) {
+		// these write nothing on most runs by design
+		return nil, errors.New("failing on zero points can not be used with band only or transition only")
+	}
+	if cfg.TransitionOnly {
+		if cfg.BandOnly {
+			return nil, errors.New("only one of band only and transition only can be enabled")
+		}
+		if len(cfg.TransitionBands) == 0 {
+			cfg.TransitionBands = []int{len(cfg.LoadBands)}
+		}
+		for _, band := range cfg.TransitionBands {
+			if band < 0 || band > len(cfg.LoadBands) {
+				return nil, fmt.Errorf("invalid transition band: %d (there are %d bands)", band, len(cfg.LoadBands)+1)
+			}
+		}
+	}
+	if cfg.EmitBandFlags && len(cfg.LoadBands) != 2 {
+		return nil, errors.New("the band flags need exactly two load bands (the medium and the overloaded threshold)")
+	}
+	if !slices.Contains([]string{"", "skip", "tag"}, cfg.DuplicatePlacePolicy) {
+		return nil, fmt.Errorf("invalid duplicate place policy: %s", cfg.DuplicatePlacePolicy)
+	}
+	if cfg.FieldLayout == "" {
+		cfg.FieldLayout = "wide"
+	}
+	if !slices.Contains([]string{"wide", "narrow"}, cfg.FieldLayout) {
+		return nil, fmt.Errorf("invalid field layout: %s", cfg.FieldLayout)
+	}
+	if cfg.FieldLayout == "narrow" && (cfg.DryRunDiff || len(cfg.BandBuckets) > 0) {
+		return nil, errors.New("the dry run diff and the band buckets need the load field, so they only work with the wide field layout")
+	}
+	if cfg.LoadSmoothingAlpha < 0 || cfg.LoadSmoothingAlpha > 1 {
+		return nil, errors.New("load smoothing alpha must be between 0 and 1")
+	}
+	if cfg.WriteRetries < 0 {
+		return nil, errors.New("write retries can not be negative")
+	}
+	if cfg.RunHistorySize < 0 {
+		return nil, errors.New("run history size can not be negative")
+	}
+	if cfg.MissingGracePolls < 0 {
+		return nil, errors.New("missing grace polls can not be negative")
+	}
+	if len(cfg.BandBuckets) > 0 {
+		if cfg.Output != "influxdb" {
+			return nil, errors.New("the band buckets only work with the influxdb output")
+		}
+		if cfg.LoadEncoding == "enum" || (len(cfg.WriteFields) > 0 && !slices.Contains(cfg.WriteFields, "load")) {
+			return nil, errors.New("the band buckets need the load field to be written")
+		}
+		for band, bucket := range cfg.BandBuckets {
+			if band < 0 || band > len(cfg.LoadBands) {
+				return nil, fmt.Errorf("invalid band %d for bucket %s, there are %d bands", band, bucket, len(cfg.LoadBands)+1)
+			}
+		}
+	}
+	if cfg.OverloadRatioThreshold < 0 || cfg.OverloadRatioThreshold > 1 {
+		return nil, errors.New("overload ratio threshold must be between 0 and 1")
+	}
+	var telegram *telegramNotifier
+	if cfg.TelegramBotToken != "" || cfg.TelegramChatID != "" {
+		if cfg.TelegramBotToken == "" || cfg.TelegramChatID == "" {
+			return nil, errors.New("both the telegram bot token and chat id are needed")
+		}
+		if cfg.OverloadRatioThreshold == 0 {
+			return nil, errors.New("the telegram notifications are sent by the overload alert, set its threshold")
+		}
+		if cfg.TelegramAPIURL == "" {
+			cfg.TelegramAPIURL = "https://api.telegram.org"
+		}
+		telegram = newTelegramNotifier(cfg.TelegramAPIURL, cfg.TelegramBotToken, cfg.TelegramChatID)
+	}
+	if cfg.TopNLoaded < 0 {
+		return nil, errors.New("top n loaded can not be negative")
+	}
+	if cfg.CollectorVersion == "" {
+		cfg.CollectorVersion = buildVersion()
+	}
+	if cfg.VersionTag && cfg.VersionField {
+		return nil, errors.New("the collector version can be either a tag or a field, not both")
+	}
+	if cfg.VersionTag {
+		log.Println("WARNING: the collector_version tag starts new series on every deploy, prefer the field unless it is needed for grouping")
+	}
+	if cfg.InstanceTag && cfg.InstanceID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("could not get the hostname for the instance id, set it explicitly: %w", err)
+		}
+		cfg.InstanceID = hostname
+		if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+			log.Printf("WARNING: the instance tag defaults to the hostname %s, which is probably a pod name changing on every restart, "+
+				"each starting new series. Set a stable instance id.", hostname)
+		}
+	}
+	if cfg.PostRunTimeout == 0 {
+		cfg.PostRunTimeout = 30 * time.Second
+	}
+
+	for _, key := range cfg.ExtraFields {
+		if slices.Contains(apmDataKeys, key) {
+			return nil, fmt.Errorf("%s is already decoded by the watcher, it can not be an extra field", key)
+		}
+	}
+
+	w := &Watcher{
+		Config: cfg,
+		decoder: &apmDecoder{
+			fieldMap:       cfg.APMJSONFieldMap,
+			validateSchema: cfg.ValidateSchema,
+			captureExtras:  len(cfg.ExtraFields) > 0,
+		},
+		cities:    cities,
+		stats:     newRunStats(),
+		history:   newRunHistory(cfg.RunHistorySize),
+		latest:    newPlaceStatusStore(),
+		udpConn:   udpConn,
+		telegram:  telegram,
+		newTicker: newTimeTicker,
+	}
+	registerDataAgeGauge(&w.dataChange)
+	if cfg.AlertStateFile != "" {
+		w.overloadAlert.stateFile = cfg.AlertStateFile
+		err := w.overloadAlert.load()
+		if err != nil {
+			// not worth failing to start for, at worst the alert is repeated once
+			log.Printf("WARNING: could not load the alert state from %s, starting without it: %s", cfg.AlertStateFile, err)
+		}
+	}
+	return w, nil
+}
+
+// absenceCounter counts the consecutive polls each watched place was absent for
+type absenceCounter struct {
+	mu      sync.Mutex
+	counts  map[uint64]int
+	watched map[uint64]bool // the places found passing the filter since startup
+}
+
+// watch records the places found passing the filter by the current poll, returns all the ones found since startup
+func (c *absenceCounter) watch(found map[uint64]bool) []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.watched == nil {
+		c.watched = map[uint64]bool{}
+	}
+	for placeID := range found {
+		c.watched[placeID] = true
+	}
+	placeIDs := make([]uint64, 0, len(c.watched))
+	for placeID := range c.watched {
+		placeIDs = append(placeIDs, placeID)
+	}
+	slices.Sort(placeIDs)
+	return placeIDs
+}
+
+// observe records whether the place was found by the current poll, returns the number of consecutive polls it was
+// absent for (zero if found)
+func (c *absenceCounter) observe(placeID uint64, found bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if found {
+		delete(c.counts, placeID)
+		return 0
+	}
+	if c.counts == nil {
+		c.counts = map[uint64]int{}
+	}
+	c.counts[placeID]++
+	return c.counts[placeID]
+}
+
+// loadSmoother keeps the exponentially weighted moving average of the load of each place
+type loadSmoother struct {
+	mu     sync.Mutex
+	values map[uint64]float64
+}
+
+// observe adds the current load of the place to its average and returns the new average, which is the load itself on
+// the first sight of the place since startup
+func (s *loadSmoother) observe(placeID uint64, load uint8, alpha float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.values == nil {
+		s.values = map[uint64]float64{}
+	}
+	value, ok := s.values[placeID]
+	if !ok {
+		value = float64(load)
+	} else {
+		value = alpha*float64(load) + (1-alpha)*value
+	}
+	s.values[placeID] = value
+	return value
+}
+
+// extraFields returns the selected ExtraFields of the APM as fields prefixed by extra_, skipping the missing and the
+// nested ones
+func (w *Watcher) extraFields(apmData APMData) map[string]interface{} {
+	fields := make(map[string]interface{}, len(w.ExtraFields))
+	for _, key := range w.ExtraFields {
+		switch value := apmData.Extra[key].(type) {
+		case float64, string, bool:
+			fields["extra_"+key] = value
+		case nil:
+		default:
+			if _, warned := w.warnedNestedExtras.LoadOrStore(key, true); !warned {
+				log.Printf("WARNING: extra field %s is not a primitive value in the APM data, it is not written", key)
+			}
+		}
+	}
+	return fields
+}
+
+// maxEnrichedPlaces is the number of watched places above which enriching them is warned about
+const maxEnrichedPlaces = 50
+
+// runResult holds some info about a single run, it is filled even if the run fails
+type runResult struct {
+	pointsWritten  int
+	placesWritten  int // number of points of the watched places written
+	bytesWritten   int // size of the written line protocol
+	writeRetries   int // number of writes retried after a transient failure
+	apmsTotal      int // number of APMs in the fetched data
+	apmsProcessed  int // number of APMs iterated over before the run ended
+	matched        int // number of watched places found
+	overloaded     int // number of watched places found overloaded
+	overloadedAPMs []APMData
+	topLoaded      []loadedPlace // the TopNLoaded most loaded watched places
+}
+
+func (w *Watcher) newHTTPClient() *retryablehttp.Client {
+	cl := retryablehttp.NewClient()
+	cl.Logger = w.HTTPLogger
+	if w.HTTPBackoff != nil {
+		cl.Backoff = w.HTTPBackoff
+	}
+
+	transport := cl.HTTPClient.Transport.(*http.Transport)
+	transport.DisableKeepAlives = w.HTTPDisableKeepAlive
+	if w.HTTPIdleConnTimeout > 0 {
+		transport.IdleConnTimeout = w.HTTPIdleConnTimeout
+	}
+
+	if w.HTTPNetwork != "tcp" {
+		// force the IP version, the rest of the transport works as with the default one
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, w.HTTPNetwork, addr)
+			if err != nil {
+				return nil, fmt.Errorf("could not connect to %s using %s only (set by HTTP_IP_VERSION): %w", addr, w.HTTPNetwork, err)
+			}
+			return conn, nil
+		}
+	}
+
+	return cl
+}
+
+// ExponentialJitterBackoff picks a random wait between min and what the default exponential backoff would wait.
+// Spreads out retries of instances that failed at the same time.
+func ExponentialJitterBackoff(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	ceil := retryablehttp.DefaultBackoff(min, max, attemptNum, resp)
+	if ceil <= min {
+		return ceil
+	}
+	return min + time.Duration(rand.Int63n(int64(ceil-min))) // #nosec G404 -- jitter does not need crypto rand
+}
+
+// placeFieldNames are all the fields a point of a place may have
+var placeFieldNames = []string{"load", "geoLat", "geoLng", "load_delta", "source", "present", "data_lag_seconds", "load_missing", "name_original", "operator_id_original", "is_normal", "is_medium", "is_overloaded", "load_code", "load_label", "load_smoothed", "nearest_neighbor_km"}
+
+// loadCodes is the ordinal coding of the load states written with the enum load encoding
+var loadCodes = map[string]int{
+	"":              0, // empty or unknown
+	"normal loaded": 1,
+	"medium loaded": 2,
+	"overloaded":    3,
+}
+
+// validateFieldNameMap checks that only known fields are renamed, and that they do not collide with each other
+func validateFieldNameMap(fieldNameMap map[string]string) error {
+	for name := range fieldNameMap {
+		if !slices.Contains(placeFieldNames, name) {
+			return fmt.Errorf("unknown field: %s", name) // a typo would silently leave the field as is
+		}
+	}
+	seen := make(map[string]string, len(placeFieldNames))
+	for _, name := range placeFieldNames {
+		newName, ok := fieldNameMap[name]
+		if !ok {
+			newName = name
+		}
+		if newName == "" {
+			return fmt.Errorf("field %s renamed to an empty name", name)
+		}
+		if other, ok := seen[newName]; ok {
+			return fmt.Errorf("fields %s and %s would both be named %s", other, name, newName)
+		}
+		seen[newName] = name
+	}
+	return nil
+}
+
+// validateWriteFields checks that only known fields are selected, and that every point will have a field left
+func validateWriteFields(writeFields []string, emitMissing bool, loadEncoding string) error {
+	for _, name := range writeFields {
+		if !slices.Contains(placeFieldNames, name) {
+			return fmt.Errorf("unknown field: %s", name)
+		}
+	}
+	// the ones every point has
+	always := []string{"geoLat", "geoLng"}
+	if loadEncoding != "enum" {
+		always = append(always, "load")
+	}
+	if loadEncoding != "percent" {
+		always = append(always, "load_code", "load_label")
+	}
+	if !slices.ContainsFunc(writeFields, func(name string) bool { return slices.Contains(always, name) }) {
+		return fmt.Errorf("at least one of %s must be written", strings.Join(always, ", "))
+	}
+	if emitMissing && !slices.Contains(writeFields, "present") {
+		return errors.New("present must be written when missing places are emitted")
+	}
+	return nil
+}
+
+// placePoints builds the points of a place in the FieldLayout
+func (w *Watcher) placePoints(tags map[string]string, fields map[string]interface{}, ts time.Time) []*write.Point {
+	if w.FieldLayout != "narrow" {
+		return []*write.Point{influxdb2.NewPoint(w.InfluxMeasurement, tags, fields, ts)}
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	points := make([]*write.Point, 0, len(keys))
+	for _, key := range keys {
+		metricTags := make(map[string]string, len(tags)+1)
+		for k, v := range tags {
+			metricTags[k] = v
+		}
+		metricTags["metric"] = key
+		// a field key has a single type in a measurement, so every number is a float and the strings get their own
+		var value map[string]interface{}
+		switch v := fields[key].(type) {
+		case string:
+			value = map[string]interface{}{"value_string": v}
+		case bool:
+			value = map[string]interface{}{"value": 0.0}
+			if v {
+				value["value"] = 1.0
+			}
+		case uint8:
+			value = map[string]interface{}{"value": float64(v)}
+		case int:
+			value = map[string]interface{}{"value": float64(v)}
+		case float64:
+			value = map[string]interface{}{"value": v}
+		default:
+			value = map[string]interface{}{"value_string": fmt.Sprint(v)}
+		}
+		points = append(points, influxdb2.NewPoint(w.InfluxMeasurement, metricTags, value, ts))
+	}
+	return points
+}
+
+// selectFields drops the fields not listed in writeFields, keeps all of them if it is empty
+func selectFields(fields map[string]interface{}, writeFields []string) map[string]interface{} {
+	if len(writeFields) == 0 {
+		return fields
+	}
+	for name := range fields {
+		if !slices.Contains(writeFields, name) {
+			delete(fields, name)
+		}
+	}
+	return fields
+}
+
+func renameFields(fields map[string]interface{}, fieldNameMap map[string]string) map[string]interface{} {
+	if len(fieldNameMap) == 0 {
+		return fields
+	}
+	renamed := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		if newName, ok := fieldNameMap[name]; ok {
+			name = newName
+		}
+		renamed[name] = value
+	}
+	return renamed
+}
+
+// congestionIndex is the average weight of the load of all APMs, which is a 0-100 score with the default weights.
+// APMs that have a load without weight are left out.
+func congestionIndex(apmsData []APMData, weights map[string]float64) (float64, int) {
+	sum := 0.0
+	counted := 0
+	for _, apmData := range apmsData {
+		weight, ok := weights[apmData.Load]
+		if !ok {
+			continue
+		}
+		sum += weight
+		counted++
+	}
+	if counted == 0 {
+		return 0, 0
+	}
+	return sum / float64(counted), counted
+}
+
+// normalizeTag trims and collapses the whitespace of a tag value (and lowercases it if asked to) when NormalizeTags is
+// set, so cosmetic differences in the names don't split the series
+func (w *Watcher) normalizeTag(value string) string {
+	if !w.NormalizeTags {
+		return value
+	}
+	value = strings.Join(strings.Fields(value), " ")
+	if w.LowercaseTags {
+		value = strings.ToLower(value)
+	}
+	return value
+}
+
+// sourceAs tells how the url serving the data is recorded: as a "field", a "tag" or "none"
+func (w *Watcher) sourceAs() string {
+	if w.SourceAs != "" {
+		return w.SourceAs
+	}
+	if len(w.APMsURLs) > 1 {
+		return "field"
+	}
+	return "none"
+}
+
+// loadBand is the number of band thresholds the load reached
+func loadBand(load uint8, thresholds []uint8) int {
+	band := 0
+	for _, threshold := range thresholds {
+		if load >= threshold {
+			band++
+		}
+	}
+	return band
+}
+
+// loadedPlace is an entry of the most loaded places
+type loadedPlace struct {
+	placeID uint64
+	name    string
+	load    uint8
+}
+
+// addTopLoaded inserts the place into top (ordered by load descending, then by place_id), keeping at most n of them
+func addTopLoaded(top []loadedPlace, place loadedPlace, n int) []loadedPlace {
+	i, _ := slices.BinarySearchFunc(top, place, func(a, b loadedPlace) int {
+		if a.load != b.load {
+			return cmp.Compare(b.load, a.load)
+		}
+		return cmp.Compare(a.placeID, b.placeID)
+	})
+	if i >= n {
+		return top
+	}
+	top = slices.Insert(top, i, place)
+	return top[:min(len(top), n)]
+}
+
+// DefaultCongestionWeights weights each load by its numeric value, which gives a 0-100 congestion index
+func DefaultCongestionWeights() map[string]float64 {
+	weights := make(map[string]float64, len(loadMap))
+	for k, v := range loadMap {
+		weights[k] = float64(v)
+	}
+	return weights
+}
+
+func run(ctx context.Context, w *Watcher) (res runResult, err error) {
+	fetchCtx := ctx
+	if w.FetchBudget > 0 {
+		// leave the rest of the timeout to the writes
+		var cancel context.CancelFunc
+		fetchCtx, cancel = context.WithTimeout(ctx, w.FetchBudget)
+		defer cancel()
+	}
+	fetch, err := fetchAPMs(fetchCtx, w)
+	if err != nil {
+		if fetchCtx.Err() != nil && ctx.Err() == nil {
+			var runErr *RunError
+			if errors.As(err, &runErr) {
+				err = runErr.Err // reclassified below
+			}
+			err = newRunError(ctx, RunErrorTimeout, fmt.Errorf("fetch budget of %s exceeded: %w", w.FetchBudget, err))
+		}
+		return res, err
+	}
+	apmsData := fetch.apms
+	ts := fetch.ts
+	if w.TimestampSource == "last-modified" && !fetch.lastModified.IsZero() {
+		ts = fetch.lastModified
+		// a CDN with a wildly off clock should not write points far in the future or the past
+		if skew := time.Since(ts).Abs(); skew > w.MaxClockSkew {
+			log.Printf("WARNING: Last-Modified (%s) is off by %s, more than MAX_CLOCK_SKEW, using the local time instead", ts, skew.Round(time.Second))
+			ts = time.Now()
+		}
+	}
+	ts = ts.Truncate(w.InfluxPrecision) // align points on clean boundaries
+
+	if w.SortByPlaceID {
+		// reproducible output order, regardless of the payload order
+		slices.SortStableFunc(apmsData, func(a, b APMData) int {
+			return cmp.Compare(a.PlaceID, b.PlaceID)
+		})
+	}
+
+	batch := &pointBatcher{writer: w.GetWriter(), size: w.WriteBatchSize, precision: w.InfluxPrecision, deadLetter: w.DeadLetterFile, deadLetterMu: &w.deadLetterMu, maxErrors: w.MaxWriteErrors,
+		retries: w.WriteRetries, retryBackoff: w.WriteRetryBackoff}
+	batch.tags = map[string]string{}
+	batch.fields = map[string]interface{}{}
+	if w.VersionTag {
+		batch.tags["collector_version"] = w.CollectorVersion
+	}
+	if w.InstanceTag {
+		batch.tags["instance"] = w.InstanceID
+	}
+	if w.VersionField {
+		batch.fields["collector_version"] = w.CollectorVersion
+	}
+	if w.EmitPollSeq {
+		batch.fields["poll_seq"] = int64(w.pollSeq.Add(1))
+	}
+	defer func() {
+		res.pointsWritten = batch.written
+		res.bytesWritten = batch.bytes
+		res.writeRetries = batch.retried
+	}()
+	found := make(map[uint64]bool, len(w.PlaceIDs))
+	duplicates := map[uint64]int{}                       // number of the repeated occurrences of each place so far
+	logPlaces := !w.QuietStart || w.stats.runCount() > 0 // QUIET_START silences the first run only
+
+	var details map[uint64]map[string]interface{}
+	if w.EnrichDetails {
+		details = fetchDetails(ctx, w, apmsData)
+	}
+	var nearest map[uint64]float64
+	if w.EmitNearestNeighbor {
+		nearest = w.nearestNeighbors(apmsData) // recomputed every run, as the places may move
+	}
+
+	res.apmsTotal = len(apmsData)
+	for i, apmData := range apmsData {
+		res.apmsProcessed = i + 1
+		if w.watches(apmData) {
+			// this is a place of interest. Record its status
+			// a panic only skips this place when CONTINUE_ON_PLACE_PANIC is set, otherwise it fails the run
+			err = func() (err error) {
+				if w.ContinueOnPlacePanic {
+					defer func() {
+						if r := recover(); r != nil {
+							log.Printf("PANIC while processing place %d: %v (skipped)", apmData.PlaceID, r)
+							err = nil
+						}
+					}()
+				}
+
+				duplicate := found[apmData.PlaceID]
+				if duplicate {
+					duplicates[apmData.PlaceID]++
+					log.Printf("WARNING: place %d appears %d times in the APM data", apmData.PlaceID, duplicates[apmData.PlaceID]+1)
+					if w.DuplicatePlacePolicy == "skip" {
+						return nil
+					}
+				}
+
+				if logPlaces {
+					log.Printf("Found place %d", apmData.PlaceID)
+				}
+				found[apmData.PlaceID] = true
+				if !duplicate {
+					res.matched++
+				}
+
+				loadVal, ok := loadMap[apmData.Load]
+				if !ok {
+					return newRunError(ctx, RunErrorDecode, fmt.Errorf("invalid load value: %s", apmData.Load))
+				}
+				if apmData.Load == "overloaded" && !duplicate { // a place is counted once, like in matched
+					res.overloaded++
+					res.overloadedAPMs = append(res.overloadedAPMs, apmData)
+				}
+				loadMissing := false
+				if apmData.Load == "" {
+					switch w.EmptyLoadMode {
+					case "":
+						w.emptyLoadNotice.Do(func() {
+							log.Println("Notice: some places have no load, these are written as normal loaded. Set EMPTY_LOAD_MODE to tell them apart.")
+						})
+					case "value":
+						loadVal = w.EmptyLoadValue
+					case "skip":
+						if logPlaces {
+							log.Printf("Place %d has no load, skipped", apmData.PlaceID)
+						}
+						return nil
+					case "field":
+						loadMissing = true
+					}
+				}
+				if w.TopNLoaded > 0 && !loadMissing {
+					res.topLoaded = addTopLoaded(res.topLoaded, loadedPlace{apmData.PlaceID, apmData.Name, loadVal}, w.TopNLoaded)
+				}
+
+				tags := map[string]string{
+					"place_id":    strconv.FormatUint(apmData.PlaceID, 10),
+					"operator_id": w.normalizeTag(apmData.OperatorID),
+					"name":        w.normalizeTag(apmData.Name),
+				}
+				if duplicate && w.DuplicatePlacePolicy == "tag" {
+					// a separate series, so it does not overwrite the first one
+					tags["duplicate"] = strconv.Itoa(duplicates[apmData.PlaceID])
+				}
+
+				fields := map[string]interface{}{
+					"load":   loadVal,
+					"geoLat": apmData.GeoLat,
+					"geoLng": apmData.GeoLng,
+				}
+				if loadMissing {
+					delete(fields, "load")
+					fields["load_missing"] = 1
+				}
+				if w.LoadEncoding != "percent" {
+					// the code of the empty load is meaningful on its own, so it is written even if load is missing
+					fields["load_code"] = loadCodes[apmData.Load]
+					fields["load_label"] = apmData.Load
+					if apmData.Load == "" {
+						fields["load_label"] = "empty"
+					}
+				}
+				if w.LoadEncoding == "enum" {
+					delete(fields, "load")
+				}
+
+				switch w.sourceAs() {
+				case "field":
+					fields["source"] = fetch.source
+				case "tag":
+					tags["source"] = fetch.source
+				}
+
+				if w.NormalizeTags && w.KeepOriginalTags {
+					fields["name_original"] = apmData.Name
+					fields["operator_id_original"] = apmData.OperatorID
+				}
+
+				if w.EmitMissing {
+					fields["present"] = 1
+				}
+
+				if w.EmitDataLag && !fetch.lastModified.IsZero() {
+					fields["data_lag_seconds"] = fetch.ts.Sub(fetch.lastModified).Seconds()
+				}
+
+				if w.EmitBandFlags && !loadMissing {
+					band := loadBand(loadVal, w.LoadBands)
+					fields["is_normal"] = band == 0
+					fields["is_medium"] = band == 1
+					fields["is_overloaded"] = band == 2
+				}
+
+				if w.EmitLoadDelta && !loadMissing {
+					loadDelta := 0 // first sight since startup
+					if prev, ok := w.latest.get(apmData.PlaceID); ok {
+						loadDelta = int(loadVal) - int(prev.LoadValue)
+					}
+					fields["load_delta"] = loadDelta
+				}
+
+				if distance, ok := nearest[apmData.PlaceID]; ok {
+					fields["nearest_neighbor_km"] = distance
+				}
+
+				if w.LoadSmoothingAlpha > 0 && !loadMissing {
+					fields["load_smoothed"] = w.smoother.observe(apmData.PlaceID, loadVal, w.LoadSmoothingAlpha)
+				}
+
+				fields = renameFields(selectFields(fields, w.WriteFields), w.FieldNameMap)
+				for key, value := range details[apmData.PlaceID] {
+					fields[key] = value // not subject to WriteFields and FieldNameMap, these are selected by EnrichFields
+				}
+				for key, value := range w.extraFields(apmData) {
+					fields[key] = value // just like the enriched ones
+				}
+				status := placeStatus{
+					PlaceID:    apmData.PlaceID,
+					OperatorID: apmData.OperatorID,
+					Name:       apmData.Name,
+					GeoLat:     apmData.GeoLat,
+					GeoLng:     apmData.GeoLng,
+					Load:       apmData.Load,
+					LoadValue:  loadVal,
+					UpdatedAt:  ts,
+				}
+				if w.TrackMetadataChanges {
+					err := w.addMetadataChange(ctx, batch, status, ts)
+					if err != nil {
+						return err
+					}
+				}
+				if w.BandOnly {
+					if prev, ok := w.latest.get(apmData.PlaceID); ok && loadBand(prev.LoadValue, w.LoadBands) == loadBand(loadVal, w.LoadBands) {
+						w.latest.set(status) // still the latest known state, just not worth a point
+						return nil
+					}
+				}
+				if w.TransitionOnly {
+					// a place unknown since startup counts as being outside, so a restart writes it again if inside
+					wasInside := false
+					if prev, ok := w.latest.get(apmData.PlaceID); ok {
+						wasInside = slices.Contains(w.TransitionBands, loadBand(prev.LoadValue, w.LoadBands))
+					}
+					inside := slices.Contains(w.TransitionBands, loadBand(loadVal, w.LoadBands))
+					if wasInside == inside {
+						w.latest.set(status)
+						return nil
+					}
+					transition := "left"
+					if inside {
+						transition = "entered"
+					}
+					tags["transition"] = transition
+				}
+				points := w.placePoints(tags, fields, ts)
+				for i, p := range points {
+					var afterWrite func()
+					if i == len(points)-1 {
+						afterWrite = func() {
+							w.latest.set(status)
+							res.placesWritten++
+						}
+					}
+					err := batch.add(ctx, p, afterWrite)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}()
+			if err != nil {
+				return res, err
+			}
+		}
+		// check if context is closed every iteration
+		if ctx.Err() != nil {
+			return res, newRunError(ctx, RunErrorTimeout, ctx.Err())
+		}
+	}
+
+	if w.TopNLoaded > 0 {
+		reportTopLoaded(res.topLoaded)
+	}
+
+	if w.EmitMissing {
+		placeIDs := w.PlaceIDs
+		if len(w.Cities) > 0 || len(w.Zips) > 0 {
+			// the city and the zip of a place are only known from the APM data, so only the places that passed the
+			// filter before can go missing
+			placeIDs = w.absences.watch(found)
+		}
+		for _, placeID := range placeIDs {
+			absent := w.absences.observe(placeID, found[placeID])
+			if found[placeID] {
+				continue
+			}
+			if absent < max(w.MissingGracePolls, 1) {
+				if logPlaces {
+					log.Printf("Place %d is absent from the APM data (%d of %d polls before it is missing)", placeID, absent, w.MissingGracePolls)
+				}
+				continue // may be a blip, not missing yet
+			}
+			if logPlaces {
+				log.Printf("Place %d is missing from the APM data", placeID)
+			}
+
+			// use the last known tags, so the point ends up in the same series
+			tags := map[string]string{
+				"place_id": strconv.FormatUint(placeID, 10),
+			}
+			if prev, ok := w.latest.get(placeID); ok {
+				tags["operator_id"] = w.normalizeTag(prev.OperatorID)
+				tags["name"] = w.normalizeTag(prev.Name)
+			}
+
+			fields := renameFields(map[string]interface{}{"present": 0}, w.FieldNameMap)
+			for _, p := range w.placePoints(tags, fields, ts) {
+				err = batch.add(ctx, p, nil)
+				if err != nil {
+					return res, err
+				}
+			}
+		}
+	}
+
+	if w.EmitLoadMapMeta {
+		// self-document the numeric load scale
+		fields := make(map[string]interface{}, len(loadMap))
+		for state, value := range loadMap {
+			if state == "" {
+				state = "empty" // field keys can not be empty
+			}
+			fields[state] = value
+		}
+		err = batch.add(ctx, influxdb2.NewPoint(w.InfluxMeasurement+"_meta", nil, fields, ts), nil)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	if w.CongestionWeights != nil {
+		index, counted := congestionIndex(apmsData, w.CongestionWeights)
+		congestionIndexGauge.Set(index)
+		log.Printf("Congestion index: %.1f (over %d APMs)", index, counted)
+
+		fields := map[string]interface{}{
+			"index": index,
+			"apms":  counted,
+		}
+		err = batch.add(ctx, influxdb2.NewPoint(w.InfluxMeasurement+"_congestion", nil, fields, ts), nil)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	err = batch.flush(ctx)
+	if err != nil {
+		return res, err
+	}
+
+	if w.OverloadRatioThreshold > 0 {
+		// only once the points are written, an alert about a run that failed to write would be misleading
+		message := w.overloadAlert.check(w.OverloadRatioThreshold, w.OverloadAlertCooldown, res.matched, res.overloadedAPMs)
+		if message != "" && w.telegram != nil {
+			w.telegram.notifyAsync(message) // a slow Telegram must not hold up the polls
+		}
+	}
+
+	if res.matched == 0 {
+		log.Printf("WARNING: none of the watched places were found in the %d APMs", len(apmsData))
+	}
+
+	if w.EmitRunEvents || w.EmitHeartbeat {
+		// the event can't account for itself, so it is written on its own after everything else.
+		// it is written even if nothing matched, proving that the collector is alive
+		fields := map[string]interface{}{
+			"matched": res.matched,
+		}
+		if w.EmitRunEvents {
+			fields["points"] = batch.written
+			fields["bytes"] = batch.bytes
+			fields["decoded"] = len(apmsData)
+			fields["decode_seconds"] = fetch.decodeDuration.Seconds()
+			for name, v := range fetch.headers {
+				// e.g. CF-Ray becomes header_cf_ray
+				fields["header_"+strings.ReplaceAll(strings.ToLower(name), "-", "_")] = v
+			}
+		}
+		err = batch.add(ctx, influxdb2.NewPoint(w.InfluxMeasurement+"_runs", nil, fields, ts), nil)
+		if err == nil {
+			err = batch.flush(ctx)
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+
+	if batch.failed > 0 {
+		log.Printf("%d points written, %d failed to write (places: %s)", batch.written, batch.failed, strings.Join(batch.failedPlaces, ","))
+	}
+
+	log.Println("Success!")
+	return res, nil
+}
+
+// addMetadataChange queues a point recording the change, if the name or operator_id differs from the last written one.
+// Places first seen since startup have nothing to compare to.
+func (w *Watcher) addMetadataChange(ctx context.Context, batch *pointBatcher, status placeStatus, ts time.Time) error {
+	prev, ok := w.latest.get(status.PlaceID)
+	if !ok {
+		return nil
+	}
+	name, operatorID := w.normalizeTag(status.Name), w.normalizeTag(status.OperatorID)
+	prevName, prevOperatorID := w.normalizeTag(prev.Name), w.normalizeTag(prev.OperatorID)
+	if name == prevName && operatorID == prevOperatorID {
+		return nil
+	}
+
+	log.Printf("Metadata of place %d changed: %q (%s) -> %q (%s)", status.PlaceID, prevName, prevOperatorID, name, operatorID)
+	tags := map[string]string{
+		"place_id": strconv.FormatUint(status.PlaceID, 10),
+	}
+	fields := map[string]interface{}{
+		"name":                 name,
+		"operator_id":          operatorID,
+		"previous_name":        prevName,
+		"previous_operator_id": prevOperatorID,
+	}
+	return batch.add(ctx, influxdb2.NewPoint(w.InfluxMeasurement+"_metadata", tags, fields, ts), nil)
+}
+
+func invoke(w *Watcher) (runResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
+	defer cancel()
+	res, err := run(ctx, w)
+	if err == nil && w.FailOnZeroPoints && res.placesWritten == 0 {
+		err = newRunError(context.Background(), RunErrorConfig, zeroPointsError(w, res))
+	}
+	if err != nil || w.PostRunCommand == "" {
+		return res, err
+	}
+
+	err = runPostRunCommand(w, res)
+	if err != nil {
+		if w.PostRunFailRun {
+			return res, newRunError(context.Background(), RunErrorHook, err) // the command has its own timeout
+		}
+		log.Println("Post-run command failed: ", err)
+	}
+	return res, nil
+}
+
+// zeroPointsError tells why a completed run wrote no points of the places, which likely means a config problem
+func zeroPointsError(w *Watcher, res runResult) error {
+	switch {
+	case res.matched > 0:
+		return fmt.Errorf("%d places matched, but no points were written", res.matched)
+	case len(w.Cities) > 0 || len(w.Zips) > 0:
+		// watching whole cities or zips, so the filters themselves are likely wrong
+		return fmt.Errorf("no places found in the watched cities and zips (among %d APMs), no points were written", res.apmsTotal)
+	default:
+		return fmt.Errorf("none of the %d watched places found (among %d APMs), no points were written", len(w.PlaceIDs), res.apmsTotal)
+	}
+}
+
+// safeInvoke runs a collection, logging its errors, one at a time. A recovered panic is returned as an error.
+func safeInvoke(w *Watcher) (res runResult, err error) {
+	w.runMu.Lock()
+	defer w.runMu.Unlock()
+
+	startedAt := time.Now()
+	defer func() {
+		w.history.add(startedAt, res, err) // after a panic is recovered
+	}()
+	defer func() {
+		if w.SummaryEvery > 0 && w.stats.runCount()%uint64(w.SummaryEvery) == 0 {
+			log.Println("Summary:", w.stats.summary())
+		}
+	}()
+	// Used by the daemon, so if won't crash (unless asked to)
+	if !w.CrashOnPanic {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Println("PANIC! ", r, " (recovered)")
+				w.stats.record(runResult{}, true)
+				res, err = runResult{}, fmt.Errorf("panic: %v", r)
+			}
+		}()
+	}
+
+	res, err = invoke(w)
+	w.stats.record(res, err != nil)
+	if err == nil {
+		return res, nil
+	}
+
+	kind := runErrorKind(err)
+	runErrorsTotal.WithLabelValues(kind.String()).Inc()
+	if kind == RunErrorTimeout {
+		// upstream (or influx) being slow is different from being broken
+		runTimeoutsTotal.Inc()
+		log.Printf("Timeout while running collection (processed %d of %d APMs, written %d points): %s",
+			res.apmsProcessed, res.apmsTotal, res.pointsWritten, err)
+		return res, err
+	}
+	log.Println("Error while running collection: ", err)
+	return res, err
+}
+
+// newTimeTicker is the ticker of the daemon outside the tests
+func newTimeTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// daemon runs a collection every PollInterval, until the deadline (if not nil)
+func daemon(w *Watcher, deadline <-chan time.Time) {
+	log.Println("Starting ticker...")
+	ticks, stop := w.newTicker(w.PollInterval)
+	defer stop()
+
+	for {
+		select {
+		case <-ticks:
+			log.Println("Tick!")
+			_, _ = safeInvoke(w)
+		case <-deadline:
+			log.Println("Max lifetime reached, stopping")
+			// wait for a triggered collection to finish, the scheduled ones have finished already
+			w.runMu.Lock()
+			defer w.runMu.Unlock()
+			w.telegram.wait()
+			return
+		}
+	}
+}
+
+// RunOnce runs a single collection (and the post-run command), returning its error once the alerts of the run are sent
+func (w *Watcher) RunOnce() error {
+	_, err := invoke(w)
+	w.telegram.wait()
+	return err
+}
+
+// Run runs a collection right away and then every PollInterval, forever (or for MaxLifetime). Errors and panics
+// (unless CrashOnPanic is set) are logged, so it won't crash.
+func (w *Watcher) Run() {
+	var deadline <-chan time.Time
+	if w.MaxLifetime > 0 {
+		deadline = time.After(w.MaxLifetime)
+	}
+	if w.RuntimeStatsInterval > 0 {
+		go logRuntimeStats(w.RuntimeStatsInterval)
+	}
+	_, _ = safeInvoke(w)
+	daemon(w, deadline)
+}
@@ -0,0 +1,412 @@
+package watcher
+
+import (
+	"github.com/hashicorp/go-retryablehttp"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testAPMs = `[
+	{"place_id": 1001, "operator_id": "hu1001", "name": "Alpha", "geolat": 47.5, "geolng": 19.05, "load": "normal loaded", "city": "Budapest", "zip": "1011"},
+	{"place_id": 1002, "operator_id": "hu1002", "name": "Beta", "geolat": 47.51, "geolng": 19.06, "load": "overloaded", "city": "Budapest", "zip": "1012"},
+	{"place_id": 1003, "operator_id": "hu1003", "name": "Gamma", "geolat": 46.25, "geolng": 20.15, "load": "medium loaded", "city": "Szeged", "zip": "6720"}
+]`
+
+// newTestWatcher creates a dry run Watcher fetching the apms from a test server
+func newTestWatcher(t *testing.T, apms string, cfg Config) *Watcher {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte(apms))
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg.APMsURLs = []string{srv.URL}
+	if len(cfg.PlaceIDs) == 0 && len(cfg.Cities) == 0 && len(cfg.Zips) == 0 {
+		cfg.PlaceIDs = []uint64{1001}
+	}
+	if cfg.InfluxClient == nil && cfg.Output == "" {
+		cfg.DryRun = true
+	}
+	w, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// testInflux is an InfluxDB write endpoint recording the written lines
+type testInflux struct {
+	mu     sync.Mutex
+	lines  []string
+	client influxdb2.Client
+}
+
+func newTestInflux(t *testing.T) *testInflux {
+	t.Helper()
+	influx := &testInflux{}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		influx.mu.Lock()
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			if line != "" {
+				influx.lines = append(influx.lines, line)
+			}
+		}
+		influx.mu.Unlock()
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	influx.client = influxdb2.NewClientWithOptions(srv.URL, "token", influxdb2.DefaultOptions().SetPrecision(time.Second).SetMaxRetries(0))
+	t.Cleanup(influx.client.Close)
+	return influx
+}
+
+// placeLines are the written lines of the place
+func (i *testInflux) placeLines(placeID uint64) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var lines []string
+	for _, line := range i.lines {
+		if strings.Contains(line, ",place_id="+strconv.FormatUint(placeID, 10)+" ") || strings.Contains(line, ",place_id="+strconv.FormatUint(placeID, 10)+",") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestDaemon(t *testing.T) {
+	w := newTestWatcher(t, testAPMs, Config{PollInterval: 42 * time.Minute})
+
+	ticks := make(chan time.Time)
+	var interval time.Duration
+	stopped := false
+	w.newTicker = func(d time.Duration) (<-chan time.Time, func()) {
+		interval = d
+		return ticks, func() { stopped = true }
+	}
+
+	deadline := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		daemon(w, deadline)
+		close(done)
+	}()
+
+	for i := 0; i < 3; i++ {
+		ticks <- time.Now() // received once the previous run is done
+	}
+	deadline <- time.Now()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the daemon did not stop at the deadline")
+	}
+
+	if interval != 42*time.Minute {
+		t.Errorf("ticker interval = %s, want the PollInterval", interval)
+	}
+	if !stopped {
+		t.Error("the ticker was not stopped")
+	}
+	if runs := w.stats.runCount(); runs != 3 {
+		t.Errorf("%d runs, want one per tick (3)", runs)
+	}
+}
+
+func TestDaemonDeadlineWithoutTicks(t *testing.T) {
+	w := newTestWatcher(t, testAPMs, Config{PollInterval: time.Minute})
+	w.newTicker = func(time.Duration) (<-chan time.Time, func()) {
+		return nil, func() {} // never ticks
+	}
+
+	deadline := make(chan time.Time, 1)
+	deadline <- time.Now()
+	daemon(w, deadline)
+
+	if runs := w.stats.runCount(); runs != 0 {
+		t.Errorf("%d runs before the deadline without a tick, want 0", runs)
+	}
+}
+
+func TestHTTPBackoff(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		requests++
+		if requests <= 2 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = rw.Write([]byte(testAPMs))
+	}))
+	defer srv.Close()
+
+	var attempts []int
+	w := newTestWatcher(t, testAPMs, Config{HTTPBackoff: func(_, _ time.Duration, attemptNum int, _ *http.Response) time.Duration {
+		attempts = append(attempts, attemptNum)
+		return 0
+	}})
+	resp, err := w.newHTTPClient().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want it to succeed after the retries", resp.StatusCode)
+	}
+	if !slices.Equal(attempts, []int{0, 1}) {
+		t.Errorf("backoff called for the attempts %v, want [0 1]", attempts)
+	}
+}
+
+func TestExponentialJitterBackoff(t *testing.T) {
+	const minWait, maxWait = time.Second, 30 * time.Second
+	for attempt := 0; attempt < 8; attempt++ {
+		ceil := retryablehttp.DefaultBackoff(minWait, maxWait, attempt, nil)
+		for i := 0; i < 100; i++ {
+			got := ExponentialJitterBackoff(minWait, maxWait, attempt, nil)
+			if got < minWait || got > ceil {
+				t.Fatalf("attempt %d: waits %s, want it between %s and %s", attempt, got, minWait, ceil)
+			}
+		}
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	tests := []struct {
+		name        string
+		writeFields []string
+		want        map[string]interface{}
+	}{
+		{name: "all", writeFields: nil, want: map[string]interface{}{"load": uint8(100), "geoLat": 47.5, "geoLng": 19.05, "is_overloaded": true}},
+		{name: "some", writeFields: []string{"load", "is_overloaded"}, want: map[string]interface{}{"load": uint8(100), "is_overloaded": true}},
+		{name: "absent", writeFields: []string{"load", "load_delta"}, want: map[string]interface{}{"load": uint8(100)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := map[string]interface{}{"load": uint8(100), "geoLat": 47.5, "geoLng": 19.05, "is_overloaded": true}
+			got := selectFields(fields, tt.writeFields)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectFields() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateWriteFields(t *testing.T) {
+	tests := []struct {
+		name         string
+		writeFields  []string
+		emitMissing  bool
+		loadEncoding string
+		wantErr      bool
+	}{
+		{name: "load", writeFields: []string{"load"}, loadEncoding: "percent"},
+		{name: "position only", writeFields: []string{"geoLat", "geoLng"}, loadEncoding: "percent"},
+		{name: "unknown", writeFields: []string{"load", "lod"}, loadEncoding: "percent", wantErr: true},
+		{name: "nothing always written", writeFields: []string{"load_delta", "is_overloaded"}, loadEncoding: "percent", wantErr: true},
+		{name: "enum without load", writeFields: []string{"load_code"}, loadEncoding: "enum"},
+		{name: "enum only load", writeFields: []string{"load"}, loadEncoding: "enum", wantErr: true},
+		{name: "percent only load_code", writeFields: []string{"load_code"}, loadEncoding: "percent", wantErr: true},
+		{name: "both", writeFields: []string{"load_label"}, loadEncoding: "both"},
+		{name: "missing with present", writeFields: []string{"load", "present"}, emitMissing: true, loadEncoding: "percent"},
+		{name: "missing without present", writeFields: []string{"load"}, emitMissing: true, loadEncoding: "percent", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateWriteFields(tt.writeFields, tt.emitMissing, tt.loadEncoding)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateWriteFields() error = %v, want an error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateFieldNameMap(t *testing.T) {
+	tests := []struct {
+		name         string
+		fieldNameMap map[string]string
+		wantErr      bool
+	}{
+		{name: "none"},
+		{name: "renamed", fieldNameMap: map[string]string{"geoLat": "lat", "geoLng": "lng", "load": "status"}},
+		{name: "swapped", fieldNameMap: map[string]string{"geoLat": "geoLng", "geoLng": "geoLat"}},
+		{name: "unknown", fieldNameMap: map[string]string{"laod": "status"}, wantErr: true},
+		{name: "collision", fieldNameMap: map[string]string{"geoLat": "geo", "geoLng": "geo"}, wantErr: true},
+		{name: "collision with a kept name", fieldNameMap: map[string]string{"geoLat": "load"}, wantErr: true},
+		{name: "empty name", fieldNameMap: map[string]string{"load": ""}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFieldNameMap(tt.fieldNameMap)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateFieldNameMap() error = %v, want an error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDuplicatePlaces(t *testing.T) {
+	apms := `[
+		{"place_id": 1001, "operator_id": "hu1001", "name": "Alpha", "geolat": 47.5, "geolng": 19.05, "load": "normal loaded"},
+		{"place_id": 1002, "operator_id": "hu1002", "name": "Beta", "geolat": 47.51, "geolng": 19.06, "load": "overloaded"},
+		{"place_id": 1001, "operator_id": "hu1001", "name": "Alpha", "geolat": 47.5, "geolng": 19.05, "load": "overloaded"},
+		{"place_id": 1001, "operator_id": "hu1001", "name": "Alpha", "geolat": 47.5, "geolng": 19.05, "load": "medium loaded"}
+	]`
+	tests := []struct {
+		policy string
+		want   []string // the tags and the load of the lines of place 1001
+	}{
+		{policy: "", want: []string{"place_id=1001 load=10u", "place_id=1001 load=100u", "place_id=1001 load=70u"}},
+		{policy: "skip", want: []string{"place_id=1001 load=10u"}},
+		{policy: "tag", want: []string{"place_id=1001 load=10u", "duplicate=1 place_id=1001 load=100u", "duplicate=2 place_id=1001 load=70u"}},
+	}
+	for _, tt := range tests {
+		t.Run("policy="+tt.policy, func(t *testing.T) {
+			influx := newTestInflux(t)
+			w := newTestWatcher(t, apms, Config{
+				PlaceIDs:             []uint64{1001, 1002},
+				InfluxClient:         influx.client,
+				InfluxOrg:            "org",
+				InfluxBucket:         "bucket",
+				WriteFields:          []string{"load"},
+				DuplicatePlacePolicy: tt.policy,
+			})
+			res, err := invoke(w)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// only the first occurrence of 1001 counts, it is not overloaded
+			if res.matched != 2 || res.overloaded != 1 || len(res.overloadedAPMs) != 1 || res.overloadedAPMs[0].PlaceID != 1002 {
+				t.Errorf("%d matched and %d overloaded (%+v), want 2 and 1 (place 1002)", res.matched, res.overloaded, res.overloadedAPMs)
+			}
+			var got []string
+			for _, line := range influx.placeLines(1001) {
+				got = append(got, summarizeLine(line))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("place 1001 written as %q, want %q", got, tt.want)
+			}
+			if lines := influx.placeLines(1002); len(lines) != 1 {
+				t.Errorf("place 1002 written %d times, want once", len(lines))
+			}
+		})
+	}
+}
+
+func TestEmitMissing(t *testing.T) {
+	// the second poll has only Gamma (1003)
+	polls := []string{testAPMs, `[{"place_id": 1003, "operator_id": "hu1003", "name": "Gamma", "geolat": 46.25, "geolng": 20.15, "load": "medium loaded", "city": "Szeged", "zip": "6720"}]`}
+	tests := []struct {
+		name string
+		cfg  Config
+		want []string // the missing points of both polls
+	}{
+		{name: "place ids", cfg: Config{PlaceIDs: []uint64{1001, 1004}}, want: []string{"place_id=1004 present=0i", "place_id=1001 present=0i", "place_id=1004 present=0i"}},
+		{name: "place ids and city", cfg: Config{PlaceIDs: []uint64{1001, 1003}, Cities: []string{"Budapest"}}, want: []string{"place_id=1001 present=0i"}},
+		{name: "city", cfg: Config{Cities: []string{"Budapest"}}, want: []string{"place_id=1001 present=0i", "place_id=1002 present=0i"}},
+		{name: "zip", cfg: Config{Zips: []string{"1012"}}, want: []string{"place_id=1002 present=0i"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var poll atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+				rw.Header().Set("Content-Type", "application/json")
+				_, _ = rw.Write([]byte(polls[poll.Load()]))
+			}))
+			defer srv.Close()
+
+			influx := newTestInflux(t)
+			tt.cfg.InfluxClient, tt.cfg.InfluxOrg, tt.cfg.InfluxBucket = influx.client, "org", "bucket"
+			tt.cfg.EmitMissing = true
+			w := newTestWatcher(t, "[]", tt.cfg)
+			w.APMsURLs = []string{srv.URL}
+			for i := range polls {
+				poll.Store(int32(i))
+				_, err := invoke(w)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var got []string
+			influx.mu.Lock()
+			for _, line := range influx.lines {
+				if strings.Contains(line, " present=0i ") {
+					got = append(got, summarizeLine(line))
+				}
+			}
+			influx.mu.Unlock()
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("missing points %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// summarizeLine keeps the duplicate and place_id tags and the fields of a line
+func summarizeLine(line string) string {
+	series, rest, _ := strings.Cut(line, " ")
+	fields, _, _ := strings.Cut(rest, " ")
+	var kept []string
+	for _, tag := range strings.Split(series, ",")[1:] {
+		if strings.HasPrefix(tag, "duplicate=") || strings.HasPrefix(tag, "place_id=") {
+			kept = append(kept, tag)
+		}
+	}
+	return strings.Join(append(kept, fields), " ")
+}
+
+func TestPlacePoints(t *testing.T) {
+	tags := map[string]string{"place_id": "1001", "name": "Alpha"}
+	fields := map[string]interface{}{"load": uint8(70), "geoLat": 47.5, "is_overloaded": false, "is_medium": true, "load_label": "medium loaded", "load_code": 2, "nearest_neighbor_km": 1.25}
+	ts := time.Unix(1700000000, 0)
+	tests := []struct {
+		layout string
+		want   []string
+	}{
+		{layout: "", want: []string{
+			"foxpost,name=Alpha,place_id=1001 geoLat=47.5,is_medium=true,is_overloaded=false,load=70u,load_code=2i,load_label=\"medium loaded\",nearest_neighbor_km=1.25 1700000000\n",
+		}},
+		{layout: "wide", want: []string{
+			"foxpost,name=Alpha,place_id=1001 geoLat=47.5,is_medium=true,is_overloaded=false,load=70u,load_code=2i,load_label=\"medium loaded\",nearest_neighbor_km=1.25 1700000000\n",
+		}},
+		{layout: "narrow", want: []string{
+			"foxpost,metric=geoLat,name=Alpha,place_id=1001 value=47.5 1700000000\n",
+			"foxpost,metric=is_medium,name=Alpha,place_id=1001 value=1 1700000000\n",
+			"foxpost,metric=is_overloaded,name=Alpha,place_id=1001 value=0 1700000000\n",
+			"foxpost,metric=load,name=Alpha,place_id=1001 value=70 1700000000\n",
+			"foxpost,metric=load_code,name=Alpha,place_id=1001 value=2 1700000000\n",
+			"foxpost,metric=load_label,name=Alpha,place_id=1001 value_string=\"medium loaded\" 1700000000\n",
+			"foxpost,metric=nearest_neighbor_km,name=Alpha,place_id=1001 value=1.25 1700000000\n",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run("layout="+tt.layout, func(t *testing.T) {
+			w := newTestWatcher(t, "[]", Config{FieldLayout: tt.layout})
+			var got []string
+			for _, point := range w.placePoints(tags, fields, ts) {
+				line, err := lineProtocol(point, time.Second)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, line)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("placePoints() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
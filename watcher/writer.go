@@ -0,0 +1,448 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/influxdata/influxdb-client-go/api"
+	"github.com/influxdata/influxdb-client-go/api/write"
+	protocol "github.com/influxdata/line-protocol"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PointWriter writes the collected points to the output
+type PointWriter interface {
+	WritePoint(ctx context.Context, point *write.Point) error
+	// WriteBatch writes multiple points at once, backends supporting bulk writes do it in a single request
+	WriteBatch(ctx context.Context, points []*write.Point) error
+	// Backend names the output, used as a label of the write error metric
+	Backend() string
+}
+
+// dryRunWriter only logs the points
+type dryRunWriter struct{}
+
+func (dryRunWriter) WritePoint(_ context.Context, point *write.Point) error {
+	tagsStr := ""
+	fieldsStr := ""
+	for _, tag := range point.TagList() {
+		tagsStr += fmt.Sprintf("%s=%s ", tag.Key, tag.Value)
+	}
+	for _, field := range point.FieldList() {
+		fieldsStr += fmt.Sprintf("%s=%+v ", field.Key, field.Value)
+	}
+	log.Printf("[DRY RUN]: Would write datapoint to %s: %s %s %+v", point.Name(), tagsStr, fieldsStr, point.Time())
+	return nil
+}
+
+func (dryRunWriter) Backend() string {
+	return "dry_run"
+}
+
+func (w dryRunWriter) WriteBatch(ctx context.Context, points []*write.Point) error {
+	for _, point := range points {
+		_ = w.WritePoint(ctx, point)
+	}
+	return nil
+}
+
+type influxWriter struct {
+	writeAPI api.WriteAPIBlocking
+	// the write apis of the buckets of the load bands, the points of the places in other bands go to writeAPI
+	bandAPIs    map[int]api.WriteAPIBlocking
+	bucket      string         // bucket of writeAPI
+	bandBuckets map[int]string // buckets of bandAPIs
+	measurement string
+	loadField   string
+	loadBands   []uint8
+}
+
+// bandOf tells the band of the point of a place with a band bucket, -1 for the ones going to the default bucket
+func (w influxWriter) bandOf(point *write.Point) int {
+	if len(w.bandAPIs) == 0 || point.Name() != w.measurement {
+		return -1
+	}
+	for _, field := range point.FieldList() {
+		if field.Key != w.loadField {
+			continue
+		}
+		load, _ := toFloat(field.Value)
+		band := loadBand(uint8(load), w.loadBands)
+		if _, ok := w.bandAPIs[band]; ok {
+			return band
+		}
+	}
+	return -1
+}
+
+func (w influxWriter) apiOf(band int) api.WriteAPIBlocking {
+	if band < 0 {
+		return w.writeAPI
+	}
+	return w.bandAPIs[band]
+}
+
+// bucketOf tells the bucket the point is written to
+func (w influxWriter) bucketOf(point *write.Point) string {
+	band := w.bandOf(point)
+	if band < 0 {
+		return w.bucket
+	}
+	return w.bandBuckets[band]
+}
+
+func (w influxWriter) WritePoint(ctx context.Context, point *write.Point) error {
+	return w.apiOf(w.bandOf(point)).WritePoint(ctx, point)
+}
+
+func (influxWriter) Backend() string {
+	return "influxdb"
+}
+
+// WriteBatch writes a request per bucket
+func (w influxWriter) WriteBatch(ctx context.Context, points []*write.Point) error {
+	if len(w.bandAPIs) == 0 {
+		return w.writeAPI.WritePoint(ctx, points...)
+	}
+
+	byBand := map[int][]*write.Point{}
+	bands := make([]int, 0, len(w.bandAPIs)+1)
+	for _, point := range points {
+		band := w.bandOf(point)
+		if _, ok := byBand[band]; !ok {
+			bands = append(bands, band)
+		}
+		byBand[band] = append(byBand[band], point)
+	}
+	for _, band := range bands {
+		err := w.apiOf(band).WritePoint(ctx, byBand[band]...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lineProtocol encodes the point, ending with a newline, the same way the write api of the client does
+func lineProtocol(point *write.Point, precision time.Duration) (string, error) {
+	var sb strings.Builder
+	encoder := protocol.NewEncoder(&sb)
+	encoder.SetFieldTypeSupport(protocol.UintSupport)
+	encoder.FailOnFieldErr(true)
+	encoder.SetPrecision(precision)
+	_, err := encoder.Encode(point)
+	return sb.String(), err
+}
+
+// udpWriter sends each point as a line protocol datagram, e.g. to a Telegraf UDP listener
+type udpWriter struct {
+	conn      net.Conn
+	precision time.Duration
+}
+
+// WritePoint never fails, the errors are only logged, as nothing would confirm the delivery anyway
+func (w udpWriter) WritePoint(_ context.Context, point *write.Point) error {
+	line, err := lineProtocol(point, w.precision)
+	if err != nil {
+		log.Println("Could not encode a point to send over UDP: ", err)
+		return nil
+	}
+	_, err = w.conn.Write([]byte(line))
+	if err != nil {
+		log.Println("Could not send a point over UDP: ", err)
+	}
+	return nil
+}
+
+func (udpWriter) Backend() string {
+	return "udp"
+}
+
+// WriteBatch sends one point per datagram, so they stay within the MTU
+func (w udpWriter) WriteBatch(ctx context.Context, points []*write.Point) error {
+	for _, point := range points {
+		_ = w.WritePoint(ctx, point)
+	}
+	return nil
+}
+
+// dryRunDiffWriter writes nothing, only logs the places whose load differs from their last one in InfluxDB
+type dryRunDiffWriter struct {
+	queryAPI    api.QueryAPI
+	bucket      string
+	measurement string
+	loadField   string
+	lookback    time.Duration
+	last        map[string]float64 // last load by place_id, nil until queried
+}
+
+func (w *dryRunDiffWriter) queryLast(ctx context.Context) error {
+	flux := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: -%ds)
+  |> filter(fn: (r) => r._measurement == %s and r._field == %s)
+  |> last()`, strconv.Quote(w.bucket), int64(w.lookback.Seconds()), strconv.Quote(w.measurement), strconv.Quote(w.loadField))
+
+	result, err := w.queryAPI.Query(ctx, flux)
+	if err != nil {
+		return fmt.Errorf("could not query the last loads: %w", err)
+	}
+	defer result.Close()
+
+	last := map[string]float64{}
+	for result.Next() {
+		placeID, _ := result.Record().ValueByKey("place_id").(string)
+		if load, ok := toFloat(result.Record().Value()); ok && placeID != "" {
+			last[placeID] = load
+		}
+	}
+	if result.Err() != nil {
+		return fmt.Errorf("could not query the last loads: %w", result.Err())
+	}
+	w.last = last
+	return nil
+}
+
+func (w *dryRunDiffWriter) WritePoint(ctx context.Context, point *write.Point) error {
+	if point.Name() != w.measurement {
+		return nil // only the places are compared
+	}
+	if w.last == nil {
+		err := w.queryLast(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	placeID := ""
+	for _, tag := range point.TagList() {
+		if tag.Key == "place_id" {
+			placeID = tag.Value
+		}
+	}
+	for _, field := range point.FieldList() {
+		if field.Key != w.loadField {
+			continue
+		}
+		load, _ := toFloat(field.Value)
+		prev, known := w.last[placeID]
+		if !known {
+			log.Printf("[DRY RUN DIFF]: Place %s would be new with load %v", placeID, load)
+		} else if prev != load {
+			log.Printf("[DRY RUN DIFF]: Place %s would change load %v -> %v", placeID, prev, load)
+		}
+	}
+	return nil
+}
+
+func (*dryRunDiffWriter) Backend() string {
+	return "dry_run_diff"
+}
+
+func (w *dryRunDiffWriter) WriteBatch(ctx context.Context, points []*write.Point) error {
+	for _, point := range points {
+		err := w.WritePoint(ctx, point)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+func (w *Watcher) GetWriter() PointWriter {
+	loadField := "load"
+	if renamed, ok := w.FieldNameMap[loadField]; ok {
+		loadField = renamed
+	}
+	if w.DryRunDiff {
+		return &dryRunDiffWriter{
+			queryAPI:    w.influxClient().QueryAPI(w.InfluxOrg),
+			bucket:      w.InfluxBucket,
+			measurement: w.InfluxMeasurement,
+			loadField:   loadField,
+			lookback:    w.DryRunDiffRange,
+		}
+	}
+	if w.DryRun {
+		return dryRunWriter{}
+	}
+	if w.Output == "udp" {
+		return udpWriter{conn: w.udpConn, precision: w.InfluxPrecision}
+	}
+	// Prepare the write api, because we are going to write some serious stuff now.
+	client := w.influxClient()
+	bandAPIs := make(map[int]api.WriteAPIBlocking, len(w.BandBuckets))
+	for band, bucket := range w.BandBuckets {
+		bandAPIs[band] = client.WriteAPIBlocking(w.InfluxOrg, bucket)
+	}
+	return influxWriter{
+		writeAPI:    client.WriteAPIBlocking(w.InfluxOrg, w.InfluxBucket),
+		bandAPIs:    bandAPIs,
+		bucket:      w.InfluxBucket,
+		bandBuckets: w.BandBuckets,
+		measurement: w.InfluxMeasurement,
+		loadField:   loadField,
+		loadBands:   w.LoadBands,
+	}
+}
+
+// pointBatcher collects points and writes them once the batch is full
+type pointBatcher struct {
+	writer     PointWriter
+	size       int
+	points     []*write.Point
+	afterWrite []func()
+	precision  time.Duration // used to tell the size of the written line protocol
+	written    int           // number of points successfully written so far
+	bytes      int           // size of the line protocol successfully written so far
+	deadLetter string        // file to append the points that failed to write to, disabled if empty
+	// serializes the appends to deadLetter, shared by the runs of the watcher
+	deadLetterMu *sync.Mutex
+	// number of failed writes tolerated before giving up, the first one fails the run if zero
+	maxErrors    int
+	errs         []error
+	failed       int      // number of points that failed to write
+	failedPlaces []string // place ids of the points that failed to write
+	// added to every point
+	tags   map[string]string
+	fields map[string]interface{}
+	// number of times a write failing with a transient error is retried, waiting retryBackoff (doubled every time)
+	retries      int
+	retryBackoff time.Duration
+	retried      int // number of retries so far
+}
+
+// add queues a point, afterWrite (if not nil) is called once it is written
+func (b *pointBatcher) add(ctx context.Context, point *write.Point, afterWrite func()) error {
+	for key, value := range b.tags {
+		point.AddTag(key, value)
+	}
+	for key, value := range b.fields {
+		point.AddField(key, value)
+	}
+	if len(b.tags) > 0 {
+		point.SortTags()
+	}
+	if len(b.fields) > 0 {
+		point.SortFields()
+	}
+	b.points = append(b.points, point)
+	b.afterWrite = append(b.afterWrite, afterWrite)
+	if len(b.points) >= b.size {
+		return b.flush(ctx)
+	}
+	return nil
+}
+
+// write writes the queued points, retrying the transient failures as long as the context has time for it
+func (b *pointBatcher) write(ctx context.Context) error {
+	backoff := b.retryBackoff
+	for attempt := 0; ; attempt++ {
+		var err error
+		if len(b.points) == 1 {
+			err = b.writer.WritePoint(ctx, b.points[0])
+		} else {
+			err = b.writer.WriteBatch(ctx, b.points)
+		}
+		if err == nil || ctx.Err() != nil {
+			return err // a retry could only fail on the expired context
+		}
+		if attempt >= b.retries || !transientWriteError(err) {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= backoff {
+			return err // no time left for another attempt
+		}
+
+		log.Printf("Write failed, retrying in %s (%d of %d): %s", backoff, attempt+1, b.retries, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		b.retried++
+		writeRetriesTotal.WithLabelValues(b.writer.Backend()).Inc()
+		backoff *= 2
+	}
+}
+
+// flush writes the queued points
+func (b *pointBatcher) flush(ctx context.Context) error {
+	if len(b.points) == 0 {
+		return nil
+	}
+	err := b.write(ctx)
+	if err != nil {
+		kind := RunErrorWrite
+		if transientWriteError(err) && ctx.Err() == nil {
+			kind = RunErrorUnreachable
+		}
+		err = newRunError(ctx, kind, err)
+		writeErrorsTotal.WithLabelValues(b.writer.Backend(), runErrorKind(err).String()).Inc()
+		if b.deadLetter != "" {
+			var bucketOf func(*write.Point) string
+			if writer, ok := b.writer.(influxWriter); ok {
+				bucketOf = writer.bucketOf
+			}
+			b.deadLetterMu.Lock()
+			dlErr := appendDeadLetters(b.deadLetter, b.points, bucketOf, b.precision, err)
+			b.deadLetterMu.Unlock()
+			if dlErr != nil {
+				log.Println("Could not write the failed points to the dead-letter file: ", dlErr)
+			}
+		}
+		if b.maxErrors == 0 || runErrorKind(err) == RunErrorTimeout {
+			return err // fail right away, unless asked to go on (which is pointless without time left)
+		}
+
+		b.errs = append(b.errs, errors.Unwrap(err)) // wrapped once all of them are reported
+		b.failed += len(b.points)
+		for _, point := range b.points {
+			for _, tag := range point.TagList() {
+				if tag.Key == "place_id" {
+					b.failedPlaces = append(b.failedPlaces, tag.Value)
+				}
+			}
+		}
+		b.points, b.afterWrite = b.points[:0], b.afterWrite[:0]
+		if len(b.errs) > b.maxErrors {
+			return newRunError(ctx, RunErrorWrite, fmt.Errorf("more than MAX_WRITE_ERRORS (%d) writes failed, places: %s: %w",
+				b.maxErrors, strings.Join(b.failedPlaces, ","), errors.Join(b.errs...)))
+		}
+		log.Println("Write failed, continuing: ", err)
+		return nil
+	}
+
+	b.written += len(b.points)
+	pointsWrittenTotal.Add(float64(len(b.points)))
+	for _, point := range b.points {
+		line, _ := lineProtocol(point, b.precision) // it was written, so it could be encoded
+		size := len(line)
+		b.bytes += size
+		bytesWrittenTotal.Add(float64(size))
+	}
+	for _, f := range b.afterWrite {
+		if f != nil {
+			f()
+		}
+	}
+	b.points, b.afterWrite = b.points[:0], b.afterWrite[:0]
+	return nil
+}
@@ -0,0 +1,195 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	influxdb2 "github.com/influxdata/influxdb-client-go"
+	"github.com/influxdata/influxdb-client-go/api/write"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLineProtocol(t *testing.T) {
+	ts := time.Unix(1700000000, 123456789)
+	tests := []struct {
+		name      string
+		point     *write.Point
+		precision time.Duration
+		want      string
+	}{
+		{
+			name:      "types",
+			point:     write.NewPoint("foxpost", map[string]string{"place_id": "1001"}, map[string]interface{}{"load": uint64(10), "n": int64(-3), "f": 1.5, "ok": true}, ts),
+			precision: time.Nanosecond,
+			want:      "foxpost,place_id=1001 f=1.5,load=10u,n=-3i,ok=true 1700000000123456789\n",
+		},
+		{
+			name:      "no tags",
+			point:     write.NewPoint("foxpost_run", nil, map[string]interface{}{"ok": int64(1)}, ts),
+			precision: time.Second,
+			want:      "foxpost_run ok=1i 1700000000\n",
+		},
+		{
+			name:      "escaped tags and measurement",
+			point:     write.NewPoint("fox post,x", map[string]string{"name": "Alpha Tesco, a=b"}, map[string]interface{}{"ok": true}, ts),
+			precision: time.Millisecond,
+			want:      "fox\\ post\\,x,name=Alpha\\ Tesco\\,\\ a\\=b ok=true 1700000000123\n",
+		},
+		{
+			name:      "escaped string field",
+			point:     write.NewPoint("foxpost", nil, map[string]interface{}{"s": "a \"b\" c:\\d"}, ts),
+			precision: time.Second,
+			want:      "foxpost s=\"a \\\"b\\\" c:\\\\d\" 1700000000\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lineProtocol(tt.point, tt.precision)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("lineProtocol() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineProtocolNoFields(t *testing.T) {
+	_, err := lineProtocol(write.NewPoint("foxpost", nil, nil, time.Unix(1, 0)), time.Second)
+	if err == nil {
+		t.Error("lineProtocol() of a point without fields should fail")
+	}
+}
+
+// statusError is shaped like the errors of the InfluxDB client
+type statusError struct {
+	StatusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status %d", e.StatusCode)
+}
+
+// scriptedWriter fails the writes with the errors in order, then succeeds
+type scriptedWriter struct {
+	errs  []error
+	calls int
+}
+
+func (w *scriptedWriter) WritePoint(ctx context.Context, point *write.Point) error {
+	return w.WriteBatch(ctx, []*write.Point{point})
+}
+
+func (w *scriptedWriter) WriteBatch(context.Context, []*write.Point) error {
+	w.calls++
+	if w.calls <= len(w.errs) {
+		return w.errs[w.calls-1]
+	}
+	return nil
+}
+
+func (*scriptedWriter) Backend() string {
+	return "test"
+}
+
+func TestPointBatcherRetries(t *testing.T) {
+	unavailable := &statusError{StatusCode: 503}
+	timeout := &net.OpError{Op: "dial", Err: errors.New("i/o timeout")}
+	tests := []struct {
+		name        string
+		errs        []error
+		retries     int
+		ctxTimeout  time.Duration // no deadline if zero
+		cancelled   bool
+		wantErr     bool
+		wantKind    RunErrorKind
+		wantCalls   int
+		wantRetried int
+	}{
+		{name: "success", retries: 2, wantCalls: 1},
+		{name: "transient then success", errs: []error{unavailable, &statusError{StatusCode: 429}}, retries: 2, wantCalls: 3, wantRetried: 2},
+		{name: "network error then success", errs: []error{timeout}, retries: 2, wantCalls: 2, wantRetried: 1},
+		{name: "out of retries", errs: []error{unavailable, unavailable, unavailable}, retries: 2, wantErr: true, wantKind: RunErrorUnreachable, wantCalls: 3, wantRetried: 2},
+		{name: "no retries", errs: []error{unavailable}, retries: 0, wantErr: true, wantKind: RunErrorUnreachable, wantCalls: 1},
+		{name: "not transient", errs: []error{&statusError{StatusCode: 400}}, retries: 2, wantErr: true, wantKind: RunErrorWrite, wantCalls: 1},
+		{name: "unauthorized", errs: []error{&statusError{StatusCode: 401}}, retries: 2, wantErr: true, wantKind: RunErrorWrite, wantCalls: 1},
+		{name: "expired context", errs: []error{context.Canceled}, retries: 2, cancelled: true, wantErr: true, wantKind: RunErrorWrite, wantCalls: 1},
+		{name: "no time left for the backoff", errs: []error{unavailable}, retries: 2, ctxTimeout: 5 * time.Millisecond, wantErr: true, wantKind: RunErrorUnreachable, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.ctxTimeout > 0 {
+				ctx, cancel = context.WithTimeout(context.Background(), tt.ctxTimeout)
+			}
+			defer cancel()
+			if tt.cancelled {
+				cancel()
+			}
+
+			writer := &scriptedWriter{errs: tt.errs}
+			batch := &pointBatcher{writer: writer, size: 10, precision: time.Second, retries: tt.retries, retryBackoff: 10 * time.Millisecond}
+			for _, id := range []string{"1001", "1002"} {
+				_ = batch.add(ctx, write.NewPoint("foxpost", map[string]string{"place_id": id}, map[string]interface{}{"load": uint64(10)}, time.Unix(1, 0)), nil)
+			}
+			err := batch.flush(ctx)
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("flush() error = %v, want an error: %t", err, tt.wantErr)
+			}
+			if err != nil && runErrorKind(err) != tt.wantKind {
+				t.Errorf("error kind = %s, want %s", runErrorKind(err), tt.wantKind)
+			}
+			if writer.calls != tt.wantCalls {
+				t.Errorf("%d writes, want %d", writer.calls, tt.wantCalls)
+			}
+			if batch.retried != tt.wantRetried {
+				t.Errorf("%d retries, want %d", batch.retried, tt.wantRetried)
+			}
+			if wantWritten := map[bool]int{false: 2, true: 0}[tt.wantErr]; batch.written != wantWritten {
+				t.Errorf("%d points written, want %d", batch.written, wantWritten)
+			}
+		})
+	}
+}
+
+// BenchmarkPointBatcher writes 1000 points to a local InfluxDB write endpoint, one request per point with a batch
+// size of 1 (the default of WRITE_BATCH_SIZE) and in batches otherwise
+func BenchmarkPointBatcher(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	client := influxdb2.NewClientWithOptions(srv.URL, "token", influxdb2.DefaultOptions().SetPrecision(time.Second).SetMaxRetries(0))
+	defer client.Close()
+	writer := influxWriter{writeAPI: client.WriteAPIBlocking("org", "bucket")}
+
+	const points = 1000
+	for _, size := range []int{1, 100, 1000} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				batch := &pointBatcher{writer: writer, size: size, precision: time.Second}
+				for id := 0; id < points; id++ {
+					point := write.NewPoint("foxpost", map[string]string{"place_id": strconv.Itoa(id)}, map[string]interface{}{"load": uint64(10), "geoLat": 47.5, "geoLng": 19.05}, time.Unix(1, 0))
+					err := batch.add(context.Background(), point, nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				err := batch.flush(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*points), "ns/point")
+		})
+	}
+}